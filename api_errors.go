@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIError is the uniform error envelope returned by all handlers
+type APIError struct {
+	Code      string      `json:"code"`              // machine-readable error code
+	Message   string      `json:"message"`           // human-readable description
+	Details   interface{} `json:"details,omitempty"` // error specific details (if any)
+	RequestID string      `json:"request_id"`        // id of the failed request
+}
+
+// ErrorResponse - output struct of failed requests
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// apiError is an error that knows how to be reported to a client
+type apiError struct {
+	status  int         // HTTP status code
+	code    string      // APIError.Code
+	message string      // APIError.Message
+	details interface{} // APIError.Details
+
+	retryAfter time.Duration // time the client should wait before retrying (0 - not set)
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func newAPIError(status int, code, message string) *apiError {
+	return &apiError{status: status, code: code, message: message}
+}
+
+// max size of the request body
+const maxRequestSize = 1048576
+
+// header request id is accepted from clients and returned in
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern matches request ids accepted from clients
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:@/+=-]{1,128}$`)
+
+// requestIDKey is the context key of the request id
+type requestIDKey struct{}
+
+// newRequestID generates random request id
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// incomingRequestID returns id sent by the client in X-Request-ID
+// (if it is valid) or generates a new one
+func incomingRequestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); requestIDPattern.MatchString(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+// withRequestID returns request with the id attached to its context
+func withRequestID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestID returns id of the request (empty if none attached)
+func requestID(r *http.Request) string {
+	return contextRequestID(r.Context())
+}
+
+// contextRequestID returns id of the request the context belongs to
+// (empty if none attached)
+func contextRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// writeError sends error envelope back to the caller
+func writeError(w http.ResponseWriter, r *http.Request, err *apiError) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err.retryAfter > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(err.retryAfter))
+	}
+	w.WriteHeader(err.status)
+	response := ErrorResponse{APIError{
+		Code:      err.code,
+		Message:   err.message,
+		Details:   err.details,
+		RequestID: requestID(r),
+	}}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		Error.Println(requestID(r), err)
+	}
+}
+
+// retryAfterSeconds formats Retry-After value (rounded up to seconds)
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
+
+// isStrict reports whether strict decoding is requested by ?strict=true
+func isStrict(r *http.Request) bool {
+	strict, _ := strconv.ParseBool(r.URL.Query().Get("strict"))
+	return strict
+}
+
+// decodeJSONBody reads the request body (up to maxRequestSize) and decodes
+// it into v. Content-Type (if any) should be a JSON one, any data after
+// JSON value is rejected. In strict mode unknown fields are rejected too
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) *apiError {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			e := newAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type", "request body should be application/json")
+			e.details = map[string]string{"content_type": contentType}
+			return e
+		}
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			e := newAPIError(http.StatusRequestEntityTooLarge, "payload_too_large", "request body is too large")
+			e.details = map[string]int64{"max_size": tooLarge.Limit}
+			return e
+		}
+		return newAPIError(http.StatusBadRequest, "bad_request", "failed to read request body: "+err.Error())
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if isStrict(r) {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			e := newAPIError(http.StatusBadRequest, "malformed_json", "request body is not a valid JSON")
+			e.details = map[string]interface{}{"offset": syntaxErr.Offset, "error": syntaxErr.Error()}
+			return e
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			return newAPIError(http.StatusBadRequest, "malformed_json", "request body is empty or truncated")
+		case errors.As(err, &typeErr):
+			e := newAPIError(http.StatusUnprocessableEntity, "invalid_field", "field has invalid type")
+			e.details = map[string]string{"field": typeErr.Field, "expected": typeErr.Type.String(), "got": typeErr.Value}
+			return e
+		case strings.HasPrefix(err.Error(), "json: unknown field"):
+			e := newAPIError(http.StatusUnprocessableEntity, "unknown_field", "request has unknown field")
+			e.details = map[string]string{"error": err.Error()}
+			return e
+		}
+		return newAPIError(http.StatusUnprocessableEntity, "unprocessable_entity", err.Error())
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return newAPIError(http.StatusBadRequest, "trailing_data", "request body has data after JSON value")
+	}
+	return nil
+}
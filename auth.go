@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// endpoint scopes, a key is allowed to call endpoints of its scopes
+// (admin is allowed to call all of them)
+const (
+	scopeParse    = "parse"
+	scopeSelftest = "selftest"
+	scopeAdmin    = "admin"
+)
+
+var scopes = []string{scopeParse, scopeSelftest, scopeAdmin}
+
+// length of the quota window
+const quotaWindow = time.Minute
+
+// apiKey is a client's key as stored in the keys file, e.g.
+//
+//	{"name": "backend", "secret_sha256": "<hex sha256 of the key>",
+//	 "scopes": ["parse"], "requests_per_minute": 600, "fetches_per_minute": 1000}
+type apiKey struct {
+	Name              string   `json:"name"`
+	SecretSHA256      string   `json:"secret_sha256"`
+	Scopes            []string `json:"scopes"`
+	RequestsPerMinute int      `json:"requests_per_minute"` // 0 - unlimited
+	FetchesPerMinute  int      `json:"fetches_per_minute"`  // 0 - unlimited
+
+	mutex    *sync.Mutex // protects the fields below
+	window   time.Time   // start of the current quota window
+	requests int         // # of requests within the window
+	fetches  int         // # of outbound fetches within the window
+	expUsage *expvar.Map // instrumentation: usage of the key
+}
+
+// apiKeyStore contains keys by sha256 of their secrets,
+// authentication is disabled if there are no keys loaded
+type apiKeyStore struct {
+	mutex    *sync.Mutex
+	keys     map[string]*apiKey
+	expUsage *expvar.Map // instrumentation: usage per key name
+}
+
+var apiKeys apiKeyStore
+
+// apiKeyContextKey is the context key of authenticated *apiKey
+type apiKeyContextKey struct{}
+
+// load reads keys file (json array of keys) and replaces all the keys
+func (s *apiKeyStore) load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var list []*apiKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	keys := make(map[string]*apiKey, len(list))
+	for i, k := range list {
+		hash, err := hex.DecodeString(k.SecretSHA256)
+		switch {
+		case k.Name == "":
+			return fmt.Errorf("%s: key #%d has no name", file, i)
+		case err != nil || len(hash) != sha256.Size:
+			return fmt.Errorf("%s: key %s: secret_sha256 should be hex encoded sha256", file, k.Name)
+		case k.RequestsPerMinute < 0 || k.FetchesPerMinute < 0:
+			return fmt.Errorf("%s: key %s: quotas should not be negative", file, k.Name)
+		}
+		for _, scope := range k.Scopes {
+			if !contains(scopes, scope) {
+				return fmt.Errorf("%s: key %s: unknown scope %s", file, k.Name, scope)
+			}
+		}
+		k.mutex = &sync.Mutex{}
+		k.expUsage = new(expvar.Map).Init()
+		keys[hex.EncodeToString(hash)] = k
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keys
+	s.expUsage.Init()
+	for _, k := range keys {
+		s.expUsage.Set(k.Name, k.expUsage)
+	}
+	return nil
+}
+
+// enabled reports whether authentication is required
+func (s *apiKeyStore) enabled() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.keys) > 0
+}
+
+// authorize finds key by its secret, checks the scope and the request quota
+func (s *apiKeyStore) authorize(secret, scope string) (*apiKey, *apiError) {
+	hash := sha256.Sum256([]byte(secret))
+	s.mutex.Lock()
+	k := s.keys[hex.EncodeToString(hash[:])]
+	s.mutex.Unlock()
+
+	if secret == "" || k == nil {
+		return nil, newAPIError(http.StatusUnauthorized, "unauthorized", "valid API key is required")
+	}
+	if !contains(k.Scopes, scope) && !contains(k.Scopes, scopeAdmin) {
+		k.expUsage.Add("forbidden", 1)
+		err := newAPIError(http.StatusForbidden, "forbidden", "API key has no "+scope+" scope")
+		err.details = map[string]string{"scope": scope}
+		return nil, err
+	}
+	if err := k.charge(1, 0); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// charge counts requests and fetches against the quotas of the key,
+// nothing is counted if any of quotas is exceeded
+func (k *apiKey) charge(requests, fetches int) *apiError {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(k.window) >= quotaWindow {
+		k.window, k.requests, k.fetches = now.Truncate(quotaWindow), 0, 0
+	}
+	quota, limit := "", 0
+	switch {
+	case k.RequestsPerMinute > 0 && k.requests+requests > k.RequestsPerMinute:
+		quota, limit = "requests_per_minute", k.RequestsPerMinute
+	case k.FetchesPerMinute > 0 && k.fetches+fetches > k.FetchesPerMinute:
+		quota, limit = "fetches_per_minute", k.FetchesPerMinute
+	}
+	if quota != "" {
+		k.expUsage.Add("throttled", 1)
+		err := newAPIError(http.StatusTooManyRequests, "quota_exceeded", "API key exceeded "+quota+" quota")
+		err.details = map[string]interface{}{"quota": quota, "limit": limit}
+		err.retryAfter = k.window.Add(quotaWindow).Sub(now)
+		return err
+	}
+
+	k.requests += requests
+	k.fetches += fetches
+	k.expUsage.Add("requests", int64(requests))
+	k.expUsage.Add("fetches", int64(fetches))
+	return nil
+}
+
+// chargeFetches counts outbound fetches against the quota
+// of the key the request is authenticated with (if any)
+func chargeFetches(ctx context.Context, fetches int) *apiError {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	if k == nil || fetches == 0 {
+		return nil
+	}
+	return k.charge(0, fetches)
+}
+
+// contextKeyName returns name of the key the request is authenticated
+// with (empty if authentication is disabled)
+func contextKeyName(ctx context.Context) string {
+	if k, _ := ctx.Value(apiKeyContextKey{}).(*apiKey); k != nil {
+		return k.Name
+	}
+	return ""
+}
+
+// apiKeySecret returns the key sent as "Authorization: Bearer <key>",
+// as "X-API-Key: <key>" or (browsers cannot set headers of websocket
+// requests) as "api-key.<base64url key>" websocket subprotocol
+func apiKeySecret(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, wsKeyProtocol) {
+				if key, err := base64.RawURLEncoding.DecodeString(p[len(wsKeyProtocol):]); err == nil {
+					return string(key)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// requireScope is a decorator that lets requests with a key of the
+// given scope through (all requests if authentication is disabled)
+func requireScope(inner http.HandlerFunc, scope string) http.HandlerFunc {
+	if scope == "" {
+		return inner
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiKeys.enabled() {
+			inner.ServeHTTP(w, r)
+			return
+		}
+		k, err := apiKeys.authorize(apiKeySecret(r), scope)
+		if err != nil {
+			if err.status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="parser"`)
+			}
+			writeError(w, r, err)
+			return
+		}
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k)))
+	})
+}
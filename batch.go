@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// BatchIM represents input of the batch parsing endpoint
+type BatchIM struct {
+	Messages []BatchMessage `json:"messages"`
+}
+
+// BatchMessage is a single message of the batch identified by client id
+type BatchMessage struct {
+	ID  string `json:"id"`
+	Msg string `json:"message"`
+}
+
+// BatchResponse - output struct of the batch parsing endpoint,
+// results are in the same order as input messages
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// BatchResult contains either parsing result or error of a single message
+type BatchResult struct {
+	ID     string           `json:"id"`
+	Result *ServiceResponse `json:"result,omitempty"`
+	Error  *APIError        `json:"error,omitempty"`
+}
+
+// doBatchParsingHandler accepts json payload (should be compatible with
+// BatchIM type) and parses all the messages. Links of all messages
+// are fetched at once, so each distinct link is fetched only once
+func doBatchParsingHandler(w http.ResponseWriter, r *http.Request) {
+	var payload BatchIM
+
+	defer r.Body.Close() // free resurces in any case
+
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	results, err := parseBatch(r.Context(), payload.Messages)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSONWithETag(w, r, BatchResponse{results})
+}
+
+// parseBatch validates and parses all the messages (see doBatchParsingHandler),
+// error is returned if the batch as a whole cannot be processed
+func parseBatch(ctx context.Context, messages []BatchMessage) ([]BatchResult, *apiError) {
+	requestID := contextRequestID(ctx)
+	if len(messages) == 0 {
+		return nil, newAPIError(http.StatusUnprocessableEntity, "empty_batch", "batch has no messages")
+	}
+	if len(messages) > maxBatchSize {
+		err := newAPIError(http.StatusRequestEntityTooLarge, "batch_too_large", "batch has too many messages")
+		err.details = map[string]int{"max_messages": maxBatchSize}
+		return nil, err
+	}
+
+	// validate messages and collect links of the valid ones
+	results := make([]BatchResult, len(messages))
+	seen := make(map[string]bool)
+	links := []string{}
+	for i, m := range messages {
+		results[i].ID = m.ID
+		switch {
+		case m.ID == "":
+			results[i].Error = &APIError{Code: "missing_id", Message: "message #" + strconv.Itoa(i) + " has no id", RequestID: requestID}
+		case seen[m.ID]:
+			results[i].Error = &APIError{Code: "duplicate_id", Message: "message id " + strconv.Quote(m.ID) + " is not unique", RequestID: requestID}
+		default:
+			links = append(links, parseLinks(m.Msg)...)
+		}
+		seen[m.ID] = true
+	}
+	if len(links) > maxBatchLinks {
+		err := newAPIError(http.StatusRequestEntityTooLarge, "batch_too_large", "batch has too many links")
+		err.details = map[string]int{"max_links": maxBatchLinks}
+		return nil, err
+	}
+	if err := chargeFetches(ctx, len(uniqueLinks(links))); err != nil {
+		return nil, err
+	}
+
+	fetched := fetchLinks(ctx, links)
+	for i, m := range messages {
+		if results[i].Error == nil {
+			result := newServiceResponse(m.Msg, fetched)
+			results[i].Result = &result
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// circuit breaker states
+const (
+	breakerClosed   = "closed"    // requests are passed through
+	breakerOpen     = "open"      // requests fail fast
+	breakerHalfOpen = "half-open" // single probe request is allowed
+)
+
+// max # of hosts whose breakers are kept before stale ones are dropped
+const maxBreakers = 10000
+
+// errHostUnavailable is returned for requests rejected by an open breaker
+var errHostUnavailable = errors.New("host temporarily unavailable")
+
+// circuitBreaker tracks consecutive failures of a single host
+type circuitBreaker struct {
+	state        string    // one of breaker states
+	failures     int       // # of consecutive failures
+	firstFailure time.Time // time of the first failure in a row
+	openedAt     time.Time // time the breaker was (re)opened
+	probing      bool      // half-open probe is in progress
+}
+
+// hostBreakers keeps circuit breakers for all hosts that recently failed
+type hostBreakers struct {
+	mutex     *sync.Mutex
+	hosts     map[string]*circuitBreaker
+	swept     time.Time   // time stale breakers were dropped last
+	expStates *expvar.Map // instrumentation: breaker state per host
+}
+
+var breakers hostBreakers
+
+// allow reports whether a request to the host may proceed.
+// Open breaker rejects all requests until breakerCooldown is over,
+// then turns into half-open and lets a single probe through
+func (b *hostBreakers) allow(host string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	cb, ok := b.hosts[host]
+	if !ok {
+		return true
+	}
+	switch cb.state {
+	case breakerOpen:
+		if time.Since(cb.openedAt) < breakerCooldown {
+			return false
+		}
+		cb.state = breakerHalfOpen
+		cb.probing = true
+		b.updateExportedVars(host, cb)
+		return true
+	case breakerHalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	}
+	return true
+}
+
+// report records result of a request to the host.
+// Successful request closes the breaker, breakerFailures consecutive
+// failures within breakerWindow (or failed probe) open it
+func (b *hostBreakers) report(host string, success bool) {
+	if breakerFailures <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	cb, ok := b.hosts[host]
+	if success {
+		if ok {
+			// host is back, no need to track it anymore
+			b.forget(host)
+		}
+		return
+	}
+	now := time.Now()
+	if !ok {
+		b.dropStale(now)
+		cb = &circuitBreaker{state: breakerClosed}
+		b.hosts[host] = cb
+	}
+	switch cb.state {
+	case breakerHalfOpen:
+		cb.state, cb.openedAt, cb.probing = breakerOpen, now, false
+	case breakerClosed:
+		if cb.failures == 0 || now.Sub(cb.firstFailure) > breakerWindow {
+			cb.failures, cb.firstFailure = 0, now
+		}
+		cb.failures++
+		if cb.failures >= breakerFailures {
+			cb.state, cb.openedAt = breakerOpen, now
+		}
+	}
+	b.updateExportedVars(host, cb)
+}
+
+// dropStale removes closed breakers whose failures are older than
+// breakerWindow (the next failure would reset them anyway). It runs
+// once per breakerWindow, or when there is no room for a new host, then
+// arbitrary breakers (closed ones first) are dropped till there is room
+// (mutex should be held)
+func (b *hostBreakers) dropStale(now time.Time) {
+	if now.Sub(b.swept) < breakerWindow && len(b.hosts) < maxBreakers {
+		return
+	}
+	b.swept = now
+	for host, cb := range b.hosts {
+		if cb.state == breakerClosed && now.Sub(cb.firstFailure) > breakerWindow {
+			b.forget(host)
+		}
+	}
+	for _, state := range []string{breakerClosed, breakerOpen, breakerHalfOpen} {
+		for host, cb := range b.hosts {
+			if len(b.hosts) < maxBreakers {
+				return
+			}
+			if cb.state == state {
+				b.forget(host)
+			}
+		}
+	}
+}
+
+// forget stops tracking the host (mutex should be held)
+func (b *hostBreakers) forget(host string) {
+	delete(b.hosts, host)
+	b.expStates.Delete(host)
+}
+
+// release frees the half-open probe slot taken by allow
+// without affecting the breaker state
+func (b *hostBreakers) release(host string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if cb, ok := b.hosts[host]; ok && cb.state == breakerHalfOpen {
+		cb.probing = false
+	}
+}
+
+// reportFetch records result of a fetch allowed by allow. Failures
+// caused by the caller (canceled or expired ctx, invalid url, redirect
+// policy) say nothing about the host, so they only release the probe
+func (b *hostBreakers) reportFetch(ctx context.Context, host string, err error, success bool) {
+	var urlErr *invalidURLError
+	if ctx.Err() != nil || errors.As(err, &urlErr) ||
+		errors.Is(err, errTooManyRedirects) || errors.Is(err, errInsecureRedirect) {
+		b.release(host)
+		return
+	}
+	b.report(host, success)
+}
+
+// updateExportedVars publishes breaker state of the host
+// (not thread-safe, thus should be called from thread-safe environment)
+func (b *hostBreakers) updateExportedVars(host string, cb *circuitBreaker) {
+	state := new(expvar.String)
+	state.Set(cb.state)
+	b.expStates.Set(host, state)
+}
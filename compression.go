@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// brotli level of responses, higher ones are too slow for dynamic content
+const brotliLevel = 4
+
+// encoder compresses response body
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// response encodings in order of preference (when client accepts
+// several of them equally), encoders are reused across responses
+var (
+	encodings = []string{"zstd", "br", "gzip"}
+	encoders  = map[string]*sync.Pool{
+		"zstd": &sync.Pool{New: func() interface{} {
+			enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+			return enc
+		}},
+		"br": &sync.Pool{New: func() interface{} {
+			return brotli.NewWriterLevel(nil, brotliLevel)
+		}},
+		"gzip": &sync.Pool{New: func() interface{} {
+			return gzip.NewWriter(nil)
+		}},
+	}
+)
+
+// negotiateEncoding picks response encoding by Accept-Encoding header
+// (empty if the client accepts none of supported encodings)
+func negotiateEncoding(acceptEncoding string) string {
+	weights := make(map[string]float64)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		weights[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, e := range encodings {
+		q, ok := weights[e]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// isCompressible reports whether content of the type is worth compressing
+func isCompressible(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" ||
+		mediaType == streamNDJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+// compressWriter compresses response body once it reaches compressMinSize
+// (or is flushed), smaller bodies are sent as is
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int     // status code to send (0 - not set yet)
+	buf      []byte  // body written before compression is decided on
+	started  bool    // header is sent
+	enc      encoder // nil if body is not compressed
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.started || w.status != 0 {
+		return
+	}
+	w.status = status
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		w.start(false)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.buf = append(w.buf, b...)
+		if len(w.buf) >= compressMinSize {
+			if err := w.start(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends data written so far (compressed if body is not sent yet),
+// so streaming responses are compressed as well
+func (w *compressWriter) Flush() {
+	if !w.started {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.start(true)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// start sends the header and the buffered body
+func (w *compressWriter) start(compress bool) error {
+	w.started = true
+	header := w.Header()
+	if compress && header.Get("Content-Encoding") == "" && isCompressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		w.enc = encoders[w.encoding].Get().(encoder)
+		w.enc.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.enc != nil {
+		_, err := w.enc.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// close sends whatever is left of the response to the request
+// and returns the encoder to the pool
+func (w *compressWriter) close(r *http.Request) {
+	if !w.started {
+		if w.status == 0 {
+			return // nothing is written, default response is up to net/http
+		}
+		w.start(false)
+	}
+	if w.enc != nil {
+		if err := w.enc.Close(); err != nil {
+			Error.Println(requestID(r), err)
+		}
+		w.enc.Reset(nil)
+		encoders[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+// gzipBody decompresses request body, closing it closes the original one
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// compress is a decorator that decompresses gzip request bodies and
+// compresses responses with encoding negotiated by Accept-Encoding
+func compress(inner http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeError(w, r, newAPIError(http.StatusBadRequest, "bad_request", "request body is not a valid gzip stream: "+err.Error()))
+				return
+			}
+			r.Body = gzipBody{reader, r.Body}
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		default:
+			w.Header().Set("Accept-Encoding", "gzip")
+			err := newAPIError(http.StatusUnsupportedMediaType, "unsupported_encoding", "request body should be gzip-encoded or not encoded at all")
+			err.details = map[string]interface{}{"content_encoding": encoding, "allowed": []string{"gzip", "identity"}}
+			writeError(w, r, err)
+			return
+		}
+
+		// websocket handshake needs the original (hijackable) writer
+		if compressMinSize < 0 || r.Header.Get("Upgrade") != "" {
+			inner.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			inner.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close(r)
+		inner.ServeHTTP(cw, r)
+	})
+}
+
+// etag returns weak entity tag of the response body
+// (weak, since the body is sent with different encodings)
+func etag(body []byte) string {
+	hash := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// etagMatches reports whether If-None-Match header matches the tag
+// (weak comparison)
+func etagMatches(ifNoneMatch, tag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONWithETag sends the value as JSON along with its ETag,
+// the client having the same result already gets 304 Not Modified.
+// It deliberately deviates from RFC 9110 13.1.2 (POST with matching
+// If-None-Match should not be performed and get 412): the ETag is
+// known only once the message is parsed, so 304 just saves the body
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(v); err != nil {
+		Error.Println(requestID(r), err)
+		writeError(w, r, newAPIError(http.StatusInternalServerError, "internal_error", "failed to encode response"))
+		return
+	}
+	tag := etag(body.Bytes())
+	w.Header().Set("ETag", tag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body.Bytes()); err != nil {
+		Error.Println(requestID(r), err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsSettings contains CORS settings of the API (see -cors-* flags)
+type corsSettings struct {
+	origins     string        // comma-separated origins, "*" or "https://*.example.com" (empty disables CORS)
+	methods     string        // comma-separated methods allowed (empty - all methods of the path)
+	headers     string        // comma-separated request headers allowed
+	credentials bool          // whether credentials (cookies, Authorization) are allowed
+	maxAge      time.Duration // time preflight response may be cached for (0 - not set)
+}
+
+var corsConfig = corsSettings{
+	headers: "Authorization, Content-Type, Content-Encoding, X-API-Key, Prefer, If-None-Match",
+	maxAge:  10 * time.Minute,
+}
+
+// response headers readable by browser clients
+const corsExposedHeaders = "ETag, Location, Retry-After, WWW-Authenticate, X-Request-ID"
+
+// request headers always allowed by browsers (CORS-safelisted)
+var corsSafelistedHeaders = []string{"accept", "accept-language", "content-language", "content-type"}
+
+// corsPolicy decides which cross-origin requests are allowed,
+// nil policy allows none (no CORS headers are sent)
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     map[string]bool // exact origins (lowercase)
+	wildcards   []corsWildcard  // origins with wildcard subdomain
+	methods     map[string]bool // nil - all methods of the path
+	headers     map[string]bool // lowercase header names
+	credentials bool
+	maxAge      time.Duration
+}
+
+// corsWildcard matches origins of any subdomain of the domain
+type corsWildcard struct {
+	scheme string // "https://"
+	suffix string // ".example.com"
+}
+
+var cors *corsPolicy
+
+// splitList splits comma-separated list dropping empty items
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newCORSPolicy creates policy of the settings (nil if CORS is disabled)
+func newCORSPolicy(settings corsSettings) (*corsPolicy, error) {
+	origins := splitList(settings.origins)
+	if len(origins) == 0 {
+		return nil, nil
+	}
+	p := &corsPolicy{
+		origins:     make(map[string]bool),
+		headers:     make(map[string]bool),
+		credentials: settings.credentials,
+		maxAge:      settings.maxAge,
+	}
+	for _, origin := range origins {
+		if origin == "*" {
+			// any site could act on behalf of a logged in user otherwise
+			if settings.credentials {
+				return nil, fmt.Errorf("CORS origin * cannot be combined with credentials, list the origins")
+			}
+			p.anyOrigin = true
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("CORS origin %q should be scheme://host[:port]", origin)
+		}
+		origin = strings.ToLower(u.Scheme + "://" + u.Host)
+		if strings.HasPrefix(u.Host, "*.") {
+			p.wildcards = append(p.wildcards, corsWildcard{strings.ToLower(u.Scheme + "://"), strings.ToLower(u.Host[1:])})
+			continue
+		}
+		if strings.Contains(u.Host, "*") {
+			return nil, fmt.Errorf("CORS origin %q may have wildcard only as the leftmost label", origin)
+		}
+		p.origins[origin] = true
+	}
+	if methods := splitList(settings.methods); len(methods) > 0 {
+		p.methods = make(map[string]bool)
+		for _, m := range methods {
+			p.methods[strings.ToUpper(m)] = true
+		}
+	}
+	for _, h := range splitList(settings.headers) {
+		p.headers[strings.ToLower(h)] = true
+	}
+	return p, nil
+}
+
+// allowOrigin reports whether requests from the origin are allowed,
+// wildcard origins match subdomains of any depth, but not the domain itself
+func (p *corsPolicy) allowOrigin(origin string) bool {
+	if p == nil || origin == "" {
+		return false
+	}
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if strings.HasPrefix(origin, w.scheme) && strings.HasSuffix(origin, w.suffix) &&
+			len(origin) > len(w.scheme)+len(w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowMethods returns methods allowed for cross-origin requests
+// out of the methods of the path
+func (p *corsPolicy) allowMethods(methods []string) []string {
+	allowed := []string{}
+	for _, m := range methods {
+		if m != "OPTIONS" && (p.methods == nil || p.methods[m]) {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
+
+// allowHeaders reports whether all the requested headers are allowed
+func (p *corsPolicy) allowHeaders(requested string) bool {
+	for _, h := range splitList(requested) {
+		h = strings.ToLower(h)
+		if !p.headers[h] && !contains(corsSafelistedHeaders, h) {
+			return false
+		}
+	}
+	return true
+}
+
+// setOrigin sets headers common for preflight and actual responses
+func (p *corsPolicy) setOrigin(header http.Header, origin string) {
+	if p.anyOrigin {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// apply sets CORS headers of an actual (not preflight) response
+// if the request came from an allowed origin
+func (p *corsPolicy) apply(w http.ResponseWriter, r *http.Request) {
+	if p == nil || isPreflight(r) {
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if !p.allowOrigin(origin) {
+		return
+	}
+	p.setOrigin(w.Header(), origin)
+	w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+}
+
+// isPreflight reports whether the request is a CORS preflight one
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// preflight responds to CORS preflight request of the path supporting
+// the methods, CORS headers are sent only if the request is allowed
+func (p *corsPolicy) preflight(w http.ResponseWriter, r *http.Request, methods []string) {
+	header := w.Header()
+	header.Set("Allow", strings.Join(methods, ", "))
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	allowed := p.allowMethods(methods)
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	requestedHeaders := r.Header.Get("Access-Control-Request-Headers")
+	if p.allowOrigin(origin) && contains(allowed, method) && p.allowHeaders(requestedHeaders) {
+		p.setOrigin(header, origin)
+		sort.Strings(allowed)
+		header.Set("Access-Control-Allow-Methods", strings.Join(allowed, ", "))
+		if requestedHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", requestedHeaders)
+		}
+		if p.maxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge/time.Second)))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
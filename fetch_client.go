@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// fetchClient is used for all outgoing requests, it is replaced
+// by the one configured with cmd-line flags in main (see newFetchClient)
+var fetchClient = &http.Client{CheckRedirect: checkRedirect}
+
+// fetchClientConfig contains settings of outgoing HTTP(S) requests
+type fetchClientConfig struct {
+	proxy               string        // proxy url for all schemes
+	httpProxy           string        // proxy url for http requests (overrides proxy)
+	httpsProxy          string        // proxy url for https requests (overrides proxy)
+	noProxy             string        // comma-separated hosts/domains/CIDRs not to be proxied
+	userAgent           string        // User-Agent header of all requests
+	acceptLanguage      string        // Accept-Language header of all requests (if any)
+	requestIDHeader     string        // header API request id is forwarded in (empty - not forwarded)
+	headers             headerFlags   // extra headers of all requests
+	caBundle            string        // path to PEM file with extra trusted CAs
+	tlsMinVersion       string        // min TLS version (1.0, 1.1, 1.2 or 1.3)
+	maxIdleConns        int           // max # of idle connections (total)
+	maxIdleConnsPerHost int           // max # of idle connections per host
+	idleConnTimeout     time.Duration // time an idle connection is kept open
+}
+
+var fetchConfig = fetchClientConfig{
+	userAgent:           "parser-link-preview/1.0",
+	tlsMinVersion:       "1.2",
+	maxIdleConns:        100,
+	maxIdleConnsPerHost: 2,
+	idleConnTimeout:     90 * time.Second,
+}
+
+// headerFlags collects repeatable "Name: value" cmd-line flags
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	if i := strings.Index(v, ":"); i <= 0 {
+		return fmt.Errorf("header %q is not in 'Name: value' form", v)
+	}
+	*h = append(*h, v)
+	return nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// proxyConfig returns proxy settings taken from environment (HTTP_PROXY,
+// HTTPS_PROXY, NO_PROXY) and overridden by the ones given in config (if any)
+func (c *fetchClientConfig) proxyConfig() *httpproxy.Config {
+	cfg := httpproxy.FromEnvironment()
+	if c.proxy != "" {
+		cfg.HTTPProxy, cfg.HTTPSProxy = c.proxy, c.proxy
+	}
+	if c.httpProxy != "" {
+		cfg.HTTPProxy = c.httpProxy
+	}
+	if c.httpsProxy != "" {
+		cfg.HTTPSProxy = c.httpsProxy
+	}
+	if c.noProxy != "" {
+		cfg.NoProxy = c.noProxy
+	}
+	return cfg
+}
+
+// proxyFunc returns proxy selection function for the transport
+func (c *fetchClientConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	proxy := c.proxyConfig().ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxy(r.URL)
+	}
+}
+
+// tlsConfig returns TLS settings of the transport
+func (c *fetchClientConfig) tlsConfig() (*tls.Config, error) {
+	version, ok := tlsVersions[c.tlsMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS version %q", c.tlsMinVersion)
+	}
+	cfg := &tls.Config{MinVersion: version}
+	if c.caBundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(c.caBundle)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", c.caBundle)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// newFetchClient creates HTTP client configured according to fetchClientConfig
+func newFetchClient(c fetchClientConfig) (*http.Client, error) {
+	transport, err := c.transport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport:     &headerTransport{header: c.header(), next: transport},
+		CheckRedirect: checkRedirect,
+	}, nil
+}
+
+// header returns headers set to every request
+func (c *fetchClientConfig) header() http.Header {
+	header := http.Header{}
+	header.Set("User-Agent", c.userAgent)
+	if c.acceptLanguage != "" {
+		header.Set("Accept-Language", c.acceptLanguage)
+	}
+	for _, h := range c.headers {
+		i := strings.Index(h, ":")
+		header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	return header
+}
+
+// transport returns HTTP transport with proxy, TLS and connection settings
+func (c *fetchClientConfig) transport() (*http.Transport, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Transport{
+		Proxy: c.proxyFunc(),
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          c.maxIdleConns,
+		MaxIdleConnsPerHost:   c.maxIdleConnsPerHost,
+		IdleConnTimeout:       c.idleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}, nil
+}
+
+// headerTransport sets configured headers to every outgoing request
+// (incl. the ones made to follow redirects) unless they are already set
+type headerTransport struct {
+	header http.Header
+	next   http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTripper must not modify the request, so work on a copy
+	r = r.Clone(r.Context())
+	for name, values := range t.header {
+		if _, ok := r.Header[name]; !ok {
+			r.Header[name] = values
+		}
+	}
+	return t.next.RoundTrip(r)
+}
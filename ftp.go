@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ftpMaxEntries limits directory listing read from a server
+const ftpMaxEntries = 10000
+
+// ftpEntry describes a file or a directory an FTP link points to
+type ftpEntry struct {
+	name     string    // file or directory name
+	isDir    bool      // whether the link points to a directory
+	size     int64     // file size in bytes (files only)
+	modified time.Time // file modification time (if server supports MDTM)
+	entries  []string  // directory listing (directories only)
+	more     bool      // listing has more than ftpMaxEntries entries
+}
+
+// summary returns human-readable description used as link title
+func (e *ftpEntry) summary() string {
+	if e.isDir && e.more {
+		return fmt.Sprintf("%s/ (directory, more than %d entries)", e.name, len(e.entries))
+	}
+	if e.isDir {
+		return fmt.Sprintf("%s/ (directory, %d entries)", e.name, len(e.entries))
+	}
+	if e.modified.IsZero() {
+		return fmt.Sprintf("%s (%d bytes)", e.name, e.size)
+	}
+	return fmt.Sprintf("%s (%d bytes, modified %s)", e.name, e.size, e.modified.Format("2006-01-02 15:04:05 MST"))
+}
+
+// ftpError is returned when FTP server replies with an unexpected code
+type ftpError struct {
+	reply *textproto.Error
+}
+
+func (e ftpError) Error() string {
+	return "ftp: " + e.reply.Error()
+}
+
+// redactedURL returns the link with its password masked (the link
+// as is if it cannot be parsed) to be logged or published
+func redactedURL(link string) string {
+	if u, err := url.Parse(link); err == nil {
+		return u.Redacted()
+	}
+	return link
+}
+
+// isFTPLink reports whether the link should be processed with processFTPJob
+func isFTPLink(link string) bool {
+	return strings.HasPrefix(strings.ToLower(link), "ftp://")
+}
+
+// processFTPJob is processFetchingJob counterpart for ftp:// links.
+// It applies the same limits as fetchURL does and reports either
+// file name, size and modification time or directory listing summary
+func processFTPJob(ctx context.Context, job linkProcessingJob) linkProcessingResult {
+	result := linkProcessingResult{
+		url:          job.url,
+		queueingTime: job.queueingTime,
+		attempts:     1,
+	}
+	entry, err := fetchFTP(ctx, &job)
+	result.startProcessingTime = job.startProcessingTime
+	if err != nil {
+		var ftpErr ftpError
+		if errors.As(err, &ftpErr) {
+			result.status, result.message = linkFTPError, err.Error()
+		} else {
+			result.status, result.message = classifyFetchError(err)
+		}
+	} else {
+		result.status, result.title, result.ftp = linkOK, entry.summary(), entry
+		result.finalURL = redactedURL(job.url) // do not echo the password back
+	}
+	result.endProcessingTime = time.Now()
+	return result
+}
+
+// fetchFTP connects to the server (anonymously unless URL has userinfo)
+// and retrieves information about the file or directory
+func fetchFTP(ctx context.Context, job *linkProcessingJob) (entry *ftpEntry, err error) {
+	u, err := url.Parse(job.url)
+	if err != nil {
+		return nil, &invalidURLError{err}
+	}
+	// path and credentials end up in FTP commands,
+	// line breaks there would inject commands of their own
+	password, _ := u.User.Password()
+	if strings.ContainsAny(u.Path+u.User.Username()+password, "\r\n\x00") {
+		return nil, &invalidURLError{errors.New("ftp url path or credentials contain CR, LF or NUL")}
+	}
+	host := u.Host
+	if !breakers.allow(host) {
+		job.startProcessingTime = time.Now()
+		return nil, errHostUnavailable
+	}
+	// FTP level errors (e.g. no such file) do not mean the host is down
+	defer func() {
+		var ftpErr ftpError
+		breakers.reportFetch(ctx, host, err, err == nil || errors.As(err, &ftpErr))
+	}()
+
+	// wait for the host to be available
+	if err := global.addHost(ctx, host); err != nil {
+		return nil, err
+	}
+	defer global.removeHost(host) // let other requests to the same host proceed
+
+	// ensure # of outgoing calls does not exceed limits, requests
+	// in progress are published, so the password is masked there
+	redacted, id := u.Redacted(), contextRequestID(ctx)
+	if err := global.addURL(ctx, redacted, id); err != nil {
+		return nil, err
+	}
+	defer global.removeURL(redacted, id) // let others goroutines do their job
+
+	job.startProcessingTime = time.Now()
+	return ftpStat(ctx, u)
+}
+
+// ftpConn is a control connection to FTP server
+type ftpConn struct {
+	*textproto.Conn
+	ctx  context.Context
+	host string // host the control connection is established to
+}
+
+// reply reads server reply, expectCode is either an exact code
+// or a code class (e.g. 2 means any 2xx), 0 accepts any code
+func (c *ftpConn) reply(expectCode int) (int, string, error) {
+	code, msg, err := c.ReadResponse(expectCode)
+	if e, ok := err.(*textproto.Error); ok {
+		return code, msg, ftpError{e}
+	}
+	return code, msg, err
+}
+
+// cmd sends a command and reads the reply (see reply)
+func (c *ftpConn) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	if err := c.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.reply(expectCode)
+}
+
+// ftpStat logs in and retrieves information about the path of the url
+func ftpStat(ctx context.Context, u *url.URL) (*ftpEntry, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer netConn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+	}
+	c := &ftpConn{textproto.NewConn(netConn), ctx, u.Hostname()}
+
+	if _, _, err := c.reply(220); err != nil {
+		return nil, err
+	}
+	user, password := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	code, msg, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case 230: // no password needed
+	case 331:
+		if _, _, err := c.cmd(230, "PASS %s", password); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ftpError{&textproto.Error{Code: code, Msg: msg}}
+	}
+	defer c.cmd(221, "QUIT")
+
+	if _, _, err := c.cmd(200, "TYPE I"); err != nil {
+		return nil, err
+	}
+
+	p := u.Path
+	if p == "" {
+		p = "/"
+	}
+	entry := &ftpEntry{name: path.Base(p)}
+	if !strings.HasSuffix(p, "/") {
+		if _, msg, err := c.cmd(213, "SIZE %s", p); err == nil {
+			entry.size, _ = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+			// MDTM is optional, reply is YYYYMMDDHHMMSS[.sss] in UTC
+			if _, msg, err := c.cmd(213, "MDTM %s", p); err == nil && len(msg) >= 14 {
+				entry.modified, _ = time.Parse("20060102150405", msg[:14])
+			}
+			return entry, nil
+		}
+	}
+
+	// not a file, so it should be a directory
+	if _, _, err := c.cmd(250, "CWD %s", p); err != nil {
+		return nil, err
+	}
+	entry.isDir = true
+	entry.name = strings.TrimSuffix(p, "/")
+	if entry.name != "" {
+		entry.name = path.Base(entry.name)
+	}
+	entry.entries, entry.more, err = c.nameList()
+	return entry, err
+}
+
+// nameList lists current directory using passive mode data connection,
+// it reads up to ftpMaxEntries entries and reports whether there are more
+func (c *ftpConn) nameList() ([]string, bool, error) {
+	_, msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return nil, false, err
+	}
+	// reply is "Entering Passive Mode (h1,h2,h3,h4,p1,p2)", host part is
+	// ignored and control connection host is used (as most clients do)
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return nil, false, fmt.Errorf("invalid PASV reply %q", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return nil, false, fmt.Errorf("invalid PASV reply %q", msg)
+	}
+	p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return nil, false, fmt.Errorf("invalid PASV reply %q", msg)
+	}
+
+	var dialer net.Dialer
+	data, err := dialer.DialContext(c.ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(p1<<8|p2)))
+	if err != nil {
+		return nil, false, err
+	}
+	defer data.Close()
+	if deadline, ok := c.ctx.Deadline(); ok {
+		data.SetDeadline(deadline)
+	}
+
+	if _, _, err := c.cmd(1, "NLST"); err != nil {
+		return nil, false, err
+	}
+	// listing is over once server closes data connection
+	entries := []string{}
+	scanner := bufio.NewScanner(data)
+	for scanner.Scan() {
+		if l := strings.TrimSpace(scanner.Text()); l != "" {
+			if len(entries) == ftpMaxEntries {
+				// the rest is not read, so transfer is not completed either
+				return entries, true, nil
+			}
+			entries = append(entries, path.Base(l))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	if _, _, err := c.reply(2); err != nil {
+		return nil, false, err
+	}
+	return entries, false, nil
+}
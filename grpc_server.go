@@ -0,0 +1,249 @@
+// gRPC API
+// The Parser service (see parserpb/parser.proto) mirrors the REST API:
+//   Parse       - same as POST /api/v1/parse
+//   ParseBatch  - same as POST /api/v1/parse/batch
+//   StreamParse - same as POST /api/v1/parse with "Accept: application/x-ndjson"
+// it shares parsing and fetching (limits, breakers, caches) with REST.
+// Parse options ("options" of REST requests) are not supported yet,
+// messages are parsed with the defaults (all entities, all links fetched)
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/justanothergopher/parser/parserpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// parserService implements parserpb.ParserServer
+type parserService struct {
+	parserpb.UnimplementedParserServer
+}
+
+// newGRPCServer creates gRPC server with the Parser service registered,
+// TLS is used if tlsConfig is not nil
+func newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(authorizeUnary), grpc.StreamInterceptor(authorizeStream)}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(options...)
+	parserpb.RegisterParserServer(s, &parserService{})
+	return s
+}
+
+// Parse parses a single message
+func (s *parserService) Parse(ctx context.Context, req *parserpb.ParseRequest) (*parserpb.ParseResponse, error) {
+	if err := chargeFetches(ctx, len(uniqueLinks(parseLinks(req.GetMessage())))); err != nil {
+		return nil, toGRPCError(err)
+	}
+	response := newServiceResponse(req.GetMessage(), fetchLinks(ctx, parseLinks(req.GetMessage())))
+	return toProtoResponse(response), nil
+}
+
+// ParseBatch parses many messages sharing link fetches between them
+func (s *parserService) ParseBatch(ctx context.Context, req *parserpb.ParseBatchRequest) (*parserpb.ParseBatchResponse, error) {
+	messages := make([]BatchMessage, len(req.GetMessages()))
+	for i, m := range req.GetMessages() {
+		messages[i] = BatchMessage{ID: m.GetId(), Msg: m.GetMessage()}
+	}
+	results, err := parseBatch(ctx, messages)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+
+	response := &parserpb.ParseBatchResponse{Results: make([]*parserpb.BatchResult, len(results))}
+	for i, r := range results {
+		result := &parserpb.BatchResult{Id: r.ID}
+		if r.Error != nil {
+			result.Outcome = &parserpb.BatchResult_Error{Error: &parserpb.Error{Code: r.Error.Code, Message: r.Error.Message}}
+		} else {
+			result.Outcome = &parserpb.BatchResult_Result{Result: toProtoResponse(*r.Result)}
+		}
+		response.Results[i] = result
+	}
+	return response, nil
+}
+
+// StreamParse sends entities first and then every link as soon as it is processed
+func (s *parserService) StreamParse(req *parserpb.ParseRequest, stream grpc.ServerStreamingServer[parserpb.ParseEvent]) error {
+	if err := chargeFetches(stream.Context(), len(uniqueLinks(parseLinks(req.GetMessage())))); err != nil {
+		return toGRPCError(err)
+	}
+	err := parseIncrementally(stream.Context(), req.GetMessage(), nil,
+		func(entities ServiceResponse) error {
+			return stream.Send(&parserpb.ParseEvent{Event: &parserpb.ParseEvent_Entities{Entities: toProtoResponse(entities)}})
+		},
+		func(link URLResponse) error {
+			return stream.Send(&parserpb.ParseEvent{Event: &parserpb.ParseEvent_Link{Link: toProtoLink(link)}})
+		})
+	if err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return stream.Send(&parserpb.ParseEvent{Event: &parserpb.ParseEvent_Done{Done: &parserpb.Done{}}})
+}
+
+// authorizeGRPC checks API key sent as "authorization: Bearer <key>"
+// or "x-api-key: <key>" metadata (if authentication is enabled)
+func authorizeGRPC(ctx context.Context) (context.Context, error) {
+	if !apiKeys.enabled() {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	r := &http.Request{Header: http.Header{}}
+	for _, name := range []string{"Authorization", "X-API-Key"} {
+		if v := md.Get(name); len(v) > 0 {
+			r.Header.Set(name, v[0])
+		}
+	}
+	k, err := apiKeys.authorize(apiKeySecret(r), scopeParse)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return context.WithValue(ctx, apiKeyContextKey{}, k), nil
+}
+
+// grpcRequestID attaches id sent as "x-request-id" metadata (or a new one)
+// to the call context, the id is returned in the response header
+func grpcRequestID(ctx context.Context) (context.Context, metadata.MD) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r := &http.Request{Header: http.Header{}}
+	if v := md.Get(requestIDHeader); len(v) > 0 {
+		r.Header.Set(requestIDHeader, v[0])
+	}
+	id := incomingRequestID(r)
+	return context.WithValue(ctx, requestIDKey{}, id), metadata.Pairs(requestIDHeader, id)
+}
+
+// limitGRPC applies load limits of heavy REST requests to the call (rate
+// of the peer IP, in-flight cap and shedding), the returned function frees
+// the in-flight slot once the call is done
+func limitGRPC(ctx context.Context) (func(), error) {
+	client := ""
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		client = p.Addr.String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+	}
+	if _, ok := limiter.allow(client); !ok {
+		return nil, toGRPCError(newAPIError(http.StatusTooManyRequests, "rate_limited", "too many requests, slow down"))
+	}
+	if err := limiter.acquire(); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return limiter.release, nil
+}
+
+// authorizeUnary is unary interceptor that tags calls with request id,
+// limits load and authorizes them (shed calls are not charged to keys)
+func authorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, header := grpcRequestID(ctx)
+	grpc.SetHeader(ctx, header)
+	release, err := limitGRPC(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	ctx, err = authorizeGRPC(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authorizeStream is stream interceptor that tags calls with request id,
+// limits load and authorizes them (shed calls are not charged to keys)
+func authorizeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, header := grpcRequestID(ss.Context())
+	ss.SetHeader(header)
+	release, err := limitGRPC(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, err = authorizeGRPC(ctx)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authorizedStream{ss, ctx})
+}
+
+// authorizedStream is a server stream with the authorized context
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+// toGRPCError converts API error to gRPC status
+func toGRPCError(err *apiError) error {
+	code := codes.Internal
+	switch err.status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		code = codes.InvalidArgument
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, err.code+": "+err.message)
+}
+
+// toProtoResponse converts parsing results to protobuf
+func toProtoResponse(r ServiceResponse) *parserpb.ParseResponse {
+	response := &parserpb.ParseResponse{
+		Mentions:  r.Mentions,
+		Emoticons: r.Emoticons,
+		Links:     make([]*parserpb.Link, len(r.Links)),
+	}
+	for i, l := range r.Links {
+		response.Links[i] = toProtoLink(l)
+	}
+	return response
+}
+
+// toProtoLink converts a processed link to protobuf
+func toProtoLink(l URLResponse) *parserpb.Link {
+	link := &parserpb.Link{
+		Url:          l.URL,
+		Title:        l.Title,
+		Status:       l.Status,
+		StatusCode:   int32(l.StatusCode),
+		FinalUrl:     l.FinalURL,
+		CanonicalUrl: l.CanonicalURL,
+		Message:      l.Message,
+		Attempts:     int32(l.Attempts),
+	}
+	for _, hop := range l.Redirects {
+		link.Redirects = append(link.Redirects, &parserpb.RedirectHop{Url: hop.URL, StatusCode: int32(hop.StatusCode)})
+	}
+	if l.FTP != nil {
+		link.Ftp = &parserpb.FTPInfo{
+			Name:    l.FTP.Name,
+			IsDir:   l.FTP.IsDir,
+			Size:    l.FTP.Size,
+			Entries: l.FTP.Entries,
+		}
+		if l.FTP.Modified != nil {
+			link.Ftp.ModifiedUnix = l.FTP.Modified.Unix()
+		}
+	}
+	return link
+}
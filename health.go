@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// health check statuses
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+// max time the DNS readiness check may take
+const readyDNSTimeout = time.Second
+
+// HealthCheck is result of a single readiness check
+type HealthCheck struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// HealthResponse - output struct of /healthz and /readyz
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Uptime string                 `json:"uptime,omitempty"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// doHealthzHandler reports that the process is alive
+func doHealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, r, HealthResponse{Status: healthOK, Uptime: time.Since(service.startTime).Round(time.Second).String()})
+}
+
+// doReadyzHandler reports whether the service is ready to accept requests:
+// - config: cmd-line flags and API keys are loaded
+// - caches: warm-up (-warmup-urls) is over
+// - shutdown: service is not draining
+// - fetch_pool: outbound connections are not saturated
+// - dns: -ready-dns-host can be resolved (if set)
+func doReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	started, warm := service.readiness()
+	checks := map[string]HealthCheck{
+		"config":     check(started, "service is starting"),
+		"caches":     check(warm, "warm-up is in progress"),
+		"shutdown":   check(!service.isDraining(), "service is draining"),
+		"fetch_pool": checkFetchPool(),
+	}
+	if readyDNSHost != "" {
+		checks["dns"] = checkDNS(r.Context(), readyDNSHost)
+	}
+
+	response := HealthResponse{Status: healthOK, Checks: checks}
+	for _, c := range checks {
+		if c.Status != healthOK {
+			response.Status = healthFail
+		}
+	}
+	writeHealth(w, r, response)
+}
+
+// check creates check result by its condition
+func check(ok bool, message string) HealthCheck {
+	if !ok {
+		return HealthCheck{Status: healthFail, Message: message}
+	}
+	return HealthCheck{Status: healthOK}
+}
+
+// checkFetchPool fails if all outbound connections are busy
+// and fetches wait for them longer than shedQueueWait
+func checkFetchPool() HealthCheck {
+	if len(global.processesLimit) < cap(global.processesLimit) {
+		return HealthCheck{Status: healthOK}
+	}
+	if wait := global.queueWait(); shedQueueWait > 0 && wait > shedQueueWait {
+		return HealthCheck{Status: healthFail, Message: "fetch queue wait is " + wait.Round(time.Millisecond).String()}
+	}
+	return HealthCheck{Status: healthOK, Message: "all connections are busy"}
+}
+
+// checkDNS fails if the host cannot be resolved in readyDNSTimeout
+func checkDNS(ctx context.Context, host string) HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, readyDNSTimeout)
+	defer cancel()
+	if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		return HealthCheck{Status: healthFail, Message: err.Error()}
+	}
+	return HealthCheck{Status: healthOK}
+}
+
+// writeHealth sends the response, failing one with 503
+func writeHealth(w http.ResponseWriter, r *http.Request, response HealthResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status == healthOK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		Error.Println(requestID(r), err)
+	}
+}
+
+// warmUp fetches -warmup-urls, so connections, robots.txt policies and
+// breakers of the hosts are ready before the service reports readiness
+func warmUp(urls string) {
+	links := []string{}
+	for _, u := range strings.Split(urls, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			links = append(links, u)
+		}
+	}
+	for r := range processLinks(links) {
+		if r.status != linkOK && r.status != linkNoTitle {
+			Warning.Println("warm-up of", redactedURL(r.url), "failed:", r.status, r.message)
+		}
+	}
+	service.mutex.Lock()
+	service.warm = true
+	service.mutex.Unlock()
+}
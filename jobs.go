@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// job statuses
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+)
+
+// callback (webhook) delivery statuses
+const (
+	callbackPending   = "pending"
+	callbackDelivered = "delivered"
+	callbackFailed    = "failed"
+)
+
+// headers of webhook requests
+const (
+	headerJobID     = "X-Parser-Job-Id"
+	headerTimestamp = "X-Parser-Timestamp"
+	headerSignature = "X-Parser-Signature"
+)
+
+// JobResponse represents state of an asynchronous parsing job,
+// links of the result are pending until they are processed
+type JobResponse struct {
+	ID         string           `json:"id"`
+	Status     string           `json:"status"`
+	CreatedAt  time.Time        `json:"created_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	ExpiresAt  *time.Time       `json:"expires_at,omitempty"`
+	LinksDone  int              `json:"links_done"`
+	LinksTotal int              `json:"links_total"`
+	Result     *ServiceResponse `json:"result,omitempty"`
+	Callback   *CallbackStatus  `json:"callback,omitempty"`
+}
+
+// CallbackStatus represents state of the webhook delivery
+type CallbackStatus struct {
+	URL      string `json:"url"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// parseJob is an asynchronous parsing job
+type parseJob struct {
+	owner     string      // name of the API key the job is created with
+	requestID string      // id of the API request the job is created by
+	mutex     *sync.Mutex // protects the fields below
+	state     JobResponse
+	callback  *CallbackStatus
+}
+
+// jobStore keeps jobs until they expire (jobTTL after completion)
+type jobStore struct {
+	mutex *sync.Mutex
+	jobs  map[string]*parseJob
+}
+
+var jobs = jobStore{
+	mutex: &sync.Mutex{},
+	jobs:  make(map[string]*parseJob),
+}
+
+// webhookClient delivers job results to callback urls, it is replaced
+// by the one configured with cmd-line flags in main (see newWebhookClient)
+var webhookClient = &http.Client{Timeout: webhookTimeout, CheckRedirect: noRedirects}
+
+// time a single webhook delivery attempt may take
+const webhookTimeout = 10 * time.Second
+
+// errInternalCallback is returned when callback url points to an internal
+// address (loopback, private, link-local etc.) not in -webhook-allow-hosts
+var errInternalCallback = errors.New("callback url points to an internal address")
+
+// newWebhookClient creates HTTP client sharing proxy and TLS settings with
+// the fetch client, it never connects to internal addresses of hosts not
+// allowed explicitly (proxies excepted) and does not follow redirects
+func newWebhookClient(c fetchClientConfig) (*http.Client, error) {
+	transport, err := c.transport()
+	if err != nil {
+		return nil, err
+	}
+	proxies := map[string]bool{}
+	proxyConfig := c.proxyConfig()
+	for _, p := range []string{proxyConfig.HTTPProxy, proxyConfig.HTTPSProxy} {
+		if u, err := url.Parse(p); err == nil && u.Host != "" {
+			proxies[strings.ToLower(u.Hostname())] = true
+		} else if host, _, err := net.SplitHostPort(p); err == nil {
+			proxies[strings.ToLower(host)] = true // proxy given as host:port
+		}
+	}
+	dial := transport.DialContext
+	guarded := (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		// called once the address is resolved, so DNS cannot sneak it in
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isInternalIP(ip) {
+				return errInternalCallback
+			}
+			return nil
+		},
+	}).DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if proxies[strings.ToLower(host)] || callbackHostAllowed(host) {
+			return dial(ctx, network, addr)
+		}
+		return guarded(ctx, network, addr)
+	}
+	return &http.Client{
+		Transport:     &headerTransport{header: c.header(), next: transport},
+		Timeout:       webhookTimeout,
+		CheckRedirect: noRedirects,
+	}, nil
+}
+
+// noRedirects makes client return redirect responses as is
+func noRedirects(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// isInternalIP reports whether the address is not a public unicast one
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// carrier-grade NAT range (RFC 6598)
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// callbackHostAllowed reports whether the host is in -webhook-allow-hosts
+func callbackHostAllowed(host string) bool {
+	for _, h := range splitList(webhookAllowHosts) {
+		if strings.EqualFold(strings.Trim(h, "[]"), strings.Trim(host, "[]")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAsync reports whether client asked for asynchronous processing
+// either by ?async=true or by "Prefer: respond-async" header
+func isAsync(r *http.Request) bool {
+	if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); async {
+		return true
+	}
+	return preferAsync(r)
+}
+
+// preferAsync reports whether request has "Prefer: respond-async"
+func preferAsync(r *http.Request) bool {
+	for _, v := range r.Header["Prefer"] {
+		for _, p := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(p), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateCallbackURL checks that callback url (if any) can be delivered to
+func validateCallbackURL(callback string) *apiError {
+	if callback == "" {
+		return nil
+	}
+	if webhookSecret == "" {
+		return newAPIError(http.StatusUnprocessableEntity, "callbacks_disabled", "callbacks are not configured on this server")
+	}
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		e := newAPIError(http.StatusUnprocessableEntity, "invalid_field", "callback_url should be an absolute http(s) url")
+		e.details = map[string]string{"field": "callback_url"}
+		return e
+	}
+	// names are checked once resolved (see newWebhookClient)
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+	if !callbackHostAllowed(host) && (strings.EqualFold(host, "localhost") || (ip != nil && isInternalIP(ip))) {
+		e := newAPIError(http.StatusUnprocessableEntity, "invalid_field", errInternalCallback.Error())
+		e.details = map[string]string{"field": "callback_url"}
+		return e
+	}
+	return nil
+}
+
+// startParsingJob registers a new job and starts parsing in background,
+// the result is posted to callback url (if any) once the job is done
+func startParsingJob(w http.ResponseWriter, r *http.Request, payload IM) {
+	if err := validateCallbackURL(payload.CallbackURL); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	job, err := jobs.add(payload.CallbackURL, contextKeyName(r.Context()), requestID(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// job outlives the request, so it keeps the in-flight slot of the request
+	// till it is done, its fetches are tagged with the request id as well
+	release := takeLoadSlot(r.Context())
+	go func() {
+		defer release()
+		job.run(context.WithoutCancel(r.Context()), payload.Msg, payload.Options)
+	}()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Location", "/api/v1/jobs/"+job.state.ID)
+	if preferAsync(r) {
+		w.Header().Set("Preference-Applied", "respond-async")
+	}
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job.snapshot()); err != nil {
+		Error.Println(requestID(r), err)
+	}
+}
+
+// doJobStatusHandler returns status and (partial) result of the job
+func doJobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	// jobs of other keys are reported as missing, not forbidden,
+	// so their ids cannot be probed
+	job := jobs.get(pathParam(r, "id"), contextKeyName(r.Context()))
+	if job == nil {
+		writeError(w, r, newAPIError(http.StatusNotFound, "job_not_found", "job does not exist or has expired"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(job.snapshot()); err != nil {
+		Error.Println(requestID(r), err)
+	}
+}
+
+// add registers a new running job of the key owner created
+// by the request with the given id
+func (s *jobStore) add(callback, owner, requestID string) (*parseJob, *apiError) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.jobs) >= maxJobs {
+		err := newAPIError(http.StatusServiceUnavailable, "too_many_jobs", "too many jobs, try again later")
+		err.details = map[string]int{"max_jobs": maxJobs}
+		return nil, err
+	}
+	job := &parseJob{
+		owner:     owner,
+		requestID: requestID,
+		mutex:     &sync.Mutex{},
+		state:     JobResponse{ID: newRequestID(), Status: jobRunning, CreatedAt: time.Now()},
+	}
+	if callback != "" {
+		job.callback = &CallbackStatus{URL: callback, Status: callbackPending}
+	}
+	s.jobs[job.state.ID] = job
+	return job, nil
+}
+
+// get returns job of the key owner by id (nil if there is no such job,
+// it has expired or belongs to another key)
+func (s *jobStore) get(id, owner string) *parseJob {
+	s.mutex.Lock()
+	job := s.jobs[id]
+	s.mutex.Unlock()
+	if job == nil || job.owner != owner || job.expired(time.Now()) {
+		return nil
+	}
+	return job
+}
+
+// expire removes jobs expired by the given time
+func (s *jobStore) expire(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, job := range s.jobs {
+		if job.expired(now) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// runJanitor removes expired jobs periodically
+func (s *jobStore) runJanitor() {
+	interval := jobTTL / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for now := range time.Tick(interval) {
+		s.expire(now)
+	}
+}
+
+// expired reports whether the job is done and expired by the given time
+func (j *parseJob) expired(now time.Time) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.state.ExpiresAt != nil && !now.Before(*j.state.ExpiresAt)
+}
+
+// snapshot returns copy of the job state safe to be encoded
+func (j *parseJob) snapshot() JobResponse {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	state := j.state
+	if j.state.Result != nil {
+		result := *j.state.Result
+		result.Links = append([]URLResponse{}, result.Links...)
+		state.Result = &result
+	}
+	if j.callback != nil {
+		callback := *j.callback
+		state.Callback = &callback
+	}
+	return state
+}
+
+// run parses the message updating job state as links are processed,
+// then delivers the result to the callback url (if any)
+func (j *parseJob) run(ctx context.Context, msg string, options *ParseOptions) {
+	err := parseIncrementally(ctx, msg, options,
+		func(entities ServiceResponse) error {
+			j.mutex.Lock()
+			defer j.mutex.Unlock()
+			j.state.Result = &entities
+			for _, l := range entities.Links {
+				if l.Status == linkPending {
+					j.state.LinksTotal++
+				}
+			}
+			return nil
+		},
+		func(link URLResponse) error {
+			j.mutex.Lock()
+			defer j.mutex.Unlock()
+			// same link might be mentioned several times
+			for i, l := range j.state.Result.Links {
+				if l.URL == link.URL {
+					j.state.Result.Links[i] = link
+					j.state.LinksDone++
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		Error.Println(j.requestID, "job", j.state.ID, err)
+	}
+
+	j.mutex.Lock()
+	now := time.Now()
+	expires := now.Add(jobTTL)
+	j.state.Status = jobDone
+	j.state.FinishedAt = &now
+	if j.callback == nil {
+		j.state.ExpiresAt = &expires
+	}
+	j.mutex.Unlock()
+
+	if j.callback != nil {
+		j.deliver()
+		// job is kept till the callback is delivered, so its status can be checked
+		j.mutex.Lock()
+		expires := time.Now().Add(jobTTL)
+		j.state.ExpiresAt = &expires
+		j.mutex.Unlock()
+	}
+}
+
+// deliver posts the job result to the callback url retrying
+// on network errors, 429 and 5xx responses (up to webhookRetries times)
+func (j *parseJob) deliver() {
+	state := j.snapshot()
+	state.Callback = nil
+	body, err := json.Marshal(state)
+	if err != nil {
+		Error.Println(j.requestID, "job", state.ID, err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		delay, retry, err := j.post(body, attempt)
+
+		j.mutex.Lock()
+		j.callback.Attempts = attempt
+		switch {
+		case err == nil:
+			j.callback.Status = callbackDelivered
+			j.callback.Error = ""
+		case retry && attempt <= webhookRetries:
+			j.callback.Error = err.Error()
+		default:
+			j.callback.Status = callbackFailed
+			j.callback.Error = err.Error()
+		}
+		status := j.callback.Status
+		j.mutex.Unlock()
+
+		if status != callbackPending {
+			if status == callbackFailed {
+				Warning.Println(j.requestID, "job", state.ID, "callback failed:", err)
+			}
+			return
+		}
+		time.Sleep(delay)
+	}
+}
+
+// post sends signed webhook request, on failure it reports whether
+// the request should be retried and the delay before the next attempt
+func (j *parseJob) post(body []byte, attempt int) (time.Duration, bool, error) {
+	req, err := http.NewRequest("POST", j.callback.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("User-Agent", fetchConfig.userAgent)
+	req.Header.Set(headerJobID, j.state.ID)
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerSignature, signWebhook(webhookSecret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return backoff(attempt), true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, false, nil
+	}
+	err = fmt.Errorf("callback responded %d", resp.StatusCode)
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		// callback server does not get to hold the job for longer than
+		// any other retry would
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			if d > retryMaxDelay {
+				d = retryMaxDelay
+			}
+			return d, true, err
+		}
+		return backoff(attempt), true, err
+	}
+	return 0, false, err
+}
+
+// signWebhook returns signature of the webhook: "sha256=" followed by
+// hex encoded HMAC-SHA256 of timestamp, '.' and body
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
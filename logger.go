@@ -2,8 +2,10 @@ package main
 
 import (
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -16,12 +18,22 @@ var (
 	Error   *log.Logger
 )
 
+// logOutputs are outputs of the loggers (to be flushed on exit)
+var logOutputs []io.Writer
+
+// loggers are usable right away (e.g. in tests), main re-initializes them
+func init() {
+	logInit(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
+}
+
 func logInit(
 	traceHandle io.Writer,
 	infoHandle io.Writer,
 	warningHandle io.Writer,
 	errorHandle io.Writer) {
 
+	logOutputs = []io.Writer{traceHandle, infoHandle, warningHandle, errorHandle}
+
 	Trace = log.New(traceHandle,
 		"TRACE: ",
 		log.Ldate|log.Ltime|log.Lshortfile)
@@ -39,8 +51,22 @@ func logInit(
 		log.Ldate|log.Ltime|log.Lshortfile)
 }
 
+// logFlush flushes (or syncs to disk) all logger outputs
+// that are able to do that
+func logFlush() {
+	for _, w := range logOutputs {
+		switch f := w.(type) {
+		case interface{ Flush() error }:
+			f.Flush()
+		case interface{ Sync() error }:
+			f.Sync()
+		}
+	}
+}
+
 // addLogging is just simple decorator in front of HTTP handler that
 // accepts all calls, pass it up to the origin and write log
+// (tagged with the request id)
 func addLogging(inner http.HandlerFunc, fname string) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -48,7 +74,8 @@ func addLogging(inner http.HandlerFunc, fname string) http.HandlerFunc {
 		inner.ServeHTTP(w, r)
 
 		log.Printf(
-			"%s\t%s\t%s\t%s",
+			"%s\t%s\t%s\t%s\t%s",
+			requestID(r),
 			r.Method,
 			r.RequestURI,
 			fname,
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"io"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/html"
@@ -62,45 +72,317 @@ func traverse(n *html.Node) (string, bool) {
 	return "", false
 }
 
+// link processing statuses, reported to clients as is
+const (
+	linkPending          = "pending"              // link is not processed yet (streaming only)
+	linkOK               = "ok"                   // title is retrieved
+	linkNoTitle          = "no_title"             // page is fetched, but it has no title
+	linkDNSError         = "dns_error"            // host name cannot be resolved
+	linkTimeout          = "timeout"              // fetch did not complete in time
+	linkConnectionError  = "connection_error"     // any other network level error
+	linkHTTPError        = "http_error"           // server responded with 4xx/5xx
+	linkBlocked          = "blocked"              // fetch was not attempted (e.g. host is unavailable)
+	linkTooLarge         = "too_large"            // page exceeds maxPageSize
+	linkNotHTML          = "not_html"             // content is not an HTML page
+	linkInvalidURL       = "invalid_url"          // url cannot be requested
+	linkTooManyRedirect  = "too_many_redirects"   // redirect chain is longer than maxRedirects
+	linkInsecureRedirect = "insecure_redirect"    // redirect from https to http is not allowed
+	linkDisallowed       = "disallowed_by_robots" // site owner asked not to fetch/preview the page
+	linkFTPError         = "ftp_error"            // FTP server replied with an error
+	linkCanceled         = "canceled"             // processing was canceled by the caller
+	linkSkipped          = "skipped"              // link is not fetched as requested by parsing options
+)
+
+// max size of the page content to look for the title within
+const maxPageSize = 1048576
+
 // linkProcessingJob incapsulates all data related to link processing.
 // Each job contains URL and corresponding timestamps
 type linkProcessingJob struct {
-	url                 string    // url to be fetched
-	queueingTime        time.Time // time the job was put into queue
-	startProcessingTime time.Time // time the processing(http.get) started
-	endProcessingTime   time.Time // time the processing(http.get) started
+	ctx                 context.Context // cancels the processing (nil - never)
+	url                 string          // url to be fetched
+	queueingTime        time.Time       // time the job was put into queue
+	startProcessingTime time.Time       // time the processing(http.get) started
+	endProcessingTime   time.Time       // time the processing(http.get) started
+	attempts            int             // # of fetch attempts made so far
+	redirects           []redirectHop   // redirects followed by the last attempt
+	options             fetchOptions    // per-request fetch settings
+}
+
+// redirectHop is a single redirect response in a redirect chain
+type redirectHop struct {
+	url        string // url that responded with redirect
+	statusCode int    // redirect status code (301, 302, etc.)
 }
 
 // linkProcessingResult contains link processing result
 type linkProcessingResult struct {
-	url                 string    // url
-	title               string    // retrieved title
-	queueingTime        time.Time // time the job was put into input queue
-	startProcessingTime time.Time // time the processing(http.get) started
-	endProcessingTime   time.Time // time the processing is over
+	url                 string        // url
+	title               string        // retrieved title (empty on failure)
+	status              string        // one of link processing statuses
+	statusCode          int           // HTTP status code (if any response)
+	finalURL            string        // url the content was actually fetched from
+	canonicalURL        string        // canonical url declared by the page (if any)
+	redirects           []redirectHop // redirects followed to reach finalURL
+	ftp                 *ftpEntry     // file or directory info of ftp:// links
+	message             string        // human-readable details of the failure
+	queueingTime        time.Time     // time the job was put into input queue
+	startProcessingTime time.Time     // time the processing(http.get) started
+	endProcessingTime   time.Time     // time the processing is over
+	attempts            int           // # of fetch attempts made
+}
+
+// findCanonical recursevely traverse all html nodes starting given one
+// and returns href of the first <link rel="canonical"> (if any)
+func findCanonical(n *html.Node) string {
+	if n.Type == html.ElementNode && n.Data == "link" {
+		rel, href := "", ""
+		for _, a := range n.Attr {
+			switch strings.ToLower(a.Key) {
+			case "rel":
+				rel = a.Val
+			case "href":
+				href = a.Val
+			}
+		}
+		for _, r := range strings.Fields(rel) {
+			if strings.EqualFold(r, "canonical") && href != "" {
+				return href
+			}
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if href := findCanonical(c); href != "" {
+			return href
+		}
+	}
+	return ""
+}
+
+// findMetaRobots recursevely traverse all html nodes starting given one
+// and returns directives of all <meta name="robots"> (or name equal
+// to the agent) tags
+func findMetaRobots(n *html.Node, agent string) []string {
+	var result []string
+	if n.Type == html.ElementNode && n.Data == "meta" {
+		name, content := "", ""
+		for _, a := range n.Attr {
+			switch strings.ToLower(a.Key) {
+			case "name":
+				name = a.Val
+			case "content":
+				content = a.Val
+			}
+		}
+		if strings.EqualFold(name, "robots") || strings.EqualFold(name, agent) {
+			result = append(result, splitRobotsDirectives(content)...)
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		result = append(result, findMetaRobots(c, agent)...)
+	}
+	return result
+}
+
+// htmlPage contains everything retrieved from an HTML page
+type htmlPage struct {
+	title     string   // content of <title>
+	hasTitle  bool     // whether <title> is found
+	canonical string   // href of <link rel="canonical"> as is
+	robots    []string // directives of meta robots tags
+}
+
+// parseHTMLPage reads content of http respone (up to maxPageSize)
+// and retrieves page title and canonical url
+// returns false in case of any error
+func parseHTMLPage(r io.Reader) (htmlPage, bool) {
+	doc, err := html.Parse(io.LimitReader(r, maxPageSize))
+	if err != nil {
+		return htmlPage{}, false
+	}
+	page := htmlPage{canonical: findCanonical(doc), robots: findMetaRobots(doc, robotsAgent())}
+	page.title, page.hasTitle = traverse(doc)
+	return page, true
 }
 
 // getHTMLTitle reads content of http respone and attempt
 // to find <title>xyz</title> returns false in case of either
 // any error or not title
 func getHTMLTitle(r io.Reader) (string, bool) {
-	doc, err := html.Parse(io.LimitReader(r, 1048576))
-	if err != nil {
-		return "", false
+	page, ok := parseHTMLPage(r)
+	return page.title, ok && page.hasTitle
+}
+
+// hostOf returns host (incl. port if any) of the given url,
+// or url itself if it cannot be parsed
+func hostOf(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return link
 	}
-	return traverse(doc)
+	return u.Host
 }
 
-// fetchURL wraps a call to http.Get with 3 things:
-// - 1st: do not exceed max number of simultenious http calls
-// - 2nd: track total number of requests as well as in-progress requests
-// - 3rd: trak execution start time
-func fetchURL(job *linkProcessingJob) (resp *http.Response, err error) {
-	global.addURL(job.url)          // ensure # of outgoing http calls does not exceed limits
-	defer global.removeURL(job.url) // let others goroutines do their job
+// fetchURL wraps a call to http.Get with 4 things:
+// - 1st: fail fast if the host is known to be down (circuit breaker)
+// - 2nd: do not exceed max number of simultenious http calls (per host and total)
+// - 3rd: track total number of requests as well as in-progress requests
+// (along with id of the API request they are made for)
+// - 4th: trak execution start time
+// ctx limits the time of the whole call (incl. waiting for limits)
+func fetchURL(ctx context.Context, job *linkProcessingJob) (resp *http.Response, err error) {
+	host := hostOf(job.url)
+	if !breakers.allow(host) {
+		job.startProcessingTime = time.Now()
+		return nil, errHostUnavailable
+	}
+	// every return below reports the result (or releases the probe),
+	// server side errors count as host failures as well
+	defer func() {
+		breakers.reportFetch(ctx, host, err, err == nil && resp.StatusCode < http.StatusInternalServerError)
+	}()
+
+	// wait for the host to be available
+	if err := global.addHost(ctx, host); err != nil {
+		return nil, err
+	}
+	defer global.removeHost(host) // let other requests to the same host proceed
+
+	// ensure # of outgoing http calls does not exceed limits
+	id := contextRequestID(ctx)
+	if err := global.addURL(ctx, job.url, id); err != nil {
+		return nil, err
+	}
+	defer global.removeURL(job.url, id) // let others goroutines do their job
+
+	req, err := http.NewRequest("GET", job.url, nil)
+	if err != nil {
+		return nil, &invalidURLError{err}
+	}
+	if fetchConfig.requestIDHeader != "" && id != "" {
+		req.Header.Set(fetchConfig.requestIDHeader, id)
+	}
+	if job.options.language != "" {
+		req.Header.Set("Accept-Language", job.options.language)
+	}
+
+	// redirects are recorded by checkRedirect, only the last attempt matters
+	job.redirects = nil
+	ctx = context.WithValue(ctx, redirectsKey{}, &job.redirects)
 
 	job.startProcessingTime = time.Now()
-	return http.Get(job.url)
+	resp, err = fetchClient.Do(req.WithContext(ctx))
+	return resp, err
+}
+
+// redirectsKey is the context key of *[]redirectHop
+// checkRedirect records redirect chain to
+type redirectsKey struct{}
+
+var (
+	errTooManyRedirects = errors.New("too many redirects")
+	errInsecureRedirect = errors.New("redirect from https to http is not allowed")
+)
+
+// checkRedirect is http.Client redirect policy. It records every
+// redirect response into the chain stored in request context
+// and enforces maxRedirects and https downgrade policy
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	prev := via[len(via)-1]
+	if chain, ok := req.Context().Value(redirectsKey{}).(*[]redirectHop); ok && req.Response != nil {
+		*chain = append(*chain, redirectHop{prev.URL.String(), req.Response.StatusCode})
+	}
+	if len(via) > maxRedirects {
+		return errTooManyRedirects
+	}
+	if prev.URL.Scheme == "https" && req.URL.Scheme == "http" && !allowHTTPSDowngrade {
+		return errInsecureRedirect
+	}
+	return nil
+}
+
+// isTransientError reports whether the error is worth another attempt
+// (connection was reset or closed by the server)
+func isTransientError(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryDelay decides whether a fetch attempt should be retried and
+// how long to wait before the next one. Transient errors and
+// 502/503/504 are retried using jittered exponential backoff,
+// 429 is retried after the time asked in Retry-After (if any)
+func retryDelay(resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt > fetchRetries {
+		return 0, false
+	}
+	if err != nil {
+		return backoff(attempt), isTransientError(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return backoff(attempt), true
+	case http.StatusTooManyRequests:
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return d, true
+		}
+		return backoff(attempt), true
+	}
+	return 0, false
+}
+
+// backoff returns a random delay in [d/2, d) range, where d grows
+// exponentially with attempt # starting at retryBaseDelay
+func backoff(attempt int) time.Duration {
+	d := retryBaseDelay << uint(attempt-1)
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter parses value of Retry-After header which
+// is either # of seconds or an HTTP date
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// fetchWithRetries fetches job.url retrying transient failures
+// as long as the next attempt fits into ctx deadline
+func fetchWithRetries(ctx context.Context, job *linkProcessingJob) (resp *http.Response, err error) {
+	for {
+		job.attempts++
+		resp, err = fetchURL(ctx, job)
+		delay, retry := retryDelay(resp, err, job.attempts)
+		if !retry {
+			return resp, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 }
 
 // processFetchingJob accepts job as an input, retreives content of the job.url,
@@ -111,30 +393,147 @@ func fetchURL(job *linkProcessingJob) (resp *http.Response, err error) {
 func processFetchingJob(job linkProcessingJob, out chan linkProcessingResult, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	resp, err := fetchURL(&job)
+	parent := job.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	// all attempts as well as reading the content should fit into fetchTimeout
+	timeout := fetchTimeout
+	if job.options.timeout > 0 {
+		timeout = job.options.timeout
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	// fetches still in progress once the service is drained are canceled
+	lifetime := service.startFetch()
+	defer service.endFetch()
+	stop := context.AfterFunc(lifetime, cancel)
+	defer stop()
+
+	if isFTPLink(job.url) {
+		out <- processFTPJob(ctx, job)
+		return
+	}
+
+	var resp *http.Response
+	var err error
+	allowed := !respectRobots || robots.allowed(ctx, job.url)
+	if allowed {
+		resp, err = fetchWithRetries(ctx, &job)
+	}
 
 	result := linkProcessingResult{
 		url:                 job.url,
-		title:               "Failed to get HTML title",
 		queueingTime:        job.queueingTime,
 		startProcessingTime: job.startProcessingTime,
 		endProcessingTime:   job.endProcessingTime,
+		attempts:            job.attempts,
+		redirects:           job.redirects,
 	}
 	// check for any error and return its description (if any)
-	if err != nil {
-		result.title = err.Error()
+	if !allowed {
+		result.status, result.message = linkDisallowed, "disallowed by robots.txt"
+	} else if err != nil {
+		result.status, result.message = classifyFetchError(err)
 	} else {
 		defer resp.Body.Close()
-		if title, ok := getHTMLTitle(resp.Body); ok {
-			result.title = title
-		}
+		result.statusCode = resp.StatusCode
+		result.finalURL = resp.Request.URL.String()
+		processPage(resp, &result)
 	}
 	result.endProcessingTime = time.Now()
 	out <- result
 }
 
+// invalidURLError is returned by fetchURL when request cannot be created
+type invalidURLError struct {
+	err error
+}
+
+func (e *invalidURLError) Error() string {
+	return e.err.Error()
+}
+
+// classifyFetchError maps an error returned by fetchWithRetries
+// to link processing status and human-readable message
+func classifyFetchError(err error) (string, string) {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var urlErr *invalidURLError
+	switch {
+	case errors.Is(err, errHostUnavailable):
+		return linkBlocked, err.Error()
+	case errors.Is(err, errTooManyRedirects):
+		return linkTooManyRedirect, err.Error()
+	case errors.Is(err, errInsecureRedirect):
+		return linkInsecureRedirect, err.Error()
+	case errors.As(err, &urlErr):
+		return linkInvalidURL, err.Error()
+	case errors.As(err, &dnsErr):
+		return linkDNSError, err.Error()
+	case errors.Is(err, context.Canceled):
+		return linkCanceled, err.Error()
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return linkTimeout, err.Error()
+	}
+	return linkConnectionError, err.Error()
+}
+
+// isHTML reports whether the media type is an HTML one
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// processPage looks for the title (and canonical url) of the fetched
+// page and sets link processing status, title and human-readable message.
+// Content-Type is trusted if it says the page is HTML, otherwise
+// the content is sniffed (servers often send HTML as text/plain or so)
+func processPage(resp *http.Response, result *linkProcessingResult) {
+	if resp.StatusCode >= http.StatusBadRequest {
+		result.status, result.message = linkHTTPError, resp.Status
+		return
+	}
+	if respectRobots && suppressesPreview(xRobotsTagDirectives(resp.Header)) {
+		result.status, result.message = linkDisallowed, "preview is disallowed by X-Robots-Tag"
+		return
+	}
+	body := bufio.NewReader(resp.Body)
+	if contentType := resp.Header.Get("Content-Type"); !isHTML(contentType) {
+		head, _ := body.Peek(512)
+		if !isHTML(http.DetectContentType(head)) {
+			result.status, result.message = linkNotHTML, "content type is "+contentType
+			return
+		}
+	}
+	page, _ := parseHTMLPage(body)
+	if page.canonical != "" {
+		if u, err := resp.Request.URL.Parse(page.canonical); err == nil {
+			result.canonicalURL = u.String()
+		}
+	}
+	if respectRobots && suppressesPreview(page.robots) {
+		result.status, result.message = linkDisallowed, "preview is disallowed by meta robots"
+		return
+	}
+	if page.hasTitle {
+		result.status, result.title = linkOK, page.title
+		return
+	}
+	// title might be beyond the part of the page that is parsed
+	if n, _ := io.ReadFull(body, make([]byte, 1)); n > 0 {
+		result.status, result.message = linkTooLarge, "no title within first "+strconv.Itoa(maxPageSize)+" bytes"
+		return
+	}
+	result.status, result.message = linkNoTitle, "page has no title"
+}
+
 // fetchLinksAsync runs multiple go-routings to fetch page
 // defined by input links and put result into output channel
+// as soon as it is available. The channel is closed once all
+// the links are processed
 func fetchLinksAsync(in chan linkProcessingJob) chan linkProcessingResult {
 	var wg sync.WaitGroup // used to sync between go-routines
 	out := make(chan linkProcessingResult, len(in))
@@ -143,18 +542,33 @@ func fetchLinksAsync(in chan linkProcessingJob) chan linkProcessingResult {
 		wg.Add(1)
 		go processFetchingJob(job, out, &wg)
 	}
-	wg.Wait()
-	close(out)
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
 	return out
 }
 
 // processLinks converts slice of strings into a channel of
 // linkProcessingJob and then run those jobs in async mode
-// It returns closed channel of linkProcessingResult
+// It returns channel of linkProcessingResult, which is closed
+// once all the results are delivered
 func processLinks(links []string) chan linkProcessingResult {
+	return processLinksContext(context.Background(), links)
+}
+
+// processLinksContext is processLinks that cancels all
+// the outstanding jobs once ctx is done
+func processLinksContext(ctx context.Context, links []string) chan linkProcessingResult {
+	return processLinksWithOptions(ctx, links, fetchOptions{})
+}
+
+// processLinksWithOptions is processLinksContext that applies
+// per-request fetch settings to every link
+func processLinksWithOptions(ctx context.Context, links []string, options fetchOptions) chan linkProcessingResult {
 	jobs := make(chan linkProcessingJob, len(links))
 	for _, url := range links {
-		job := linkProcessingJob{url, time.Now(), time.Time{}, time.Time{}}
+		job := linkProcessingJob{ctx: ctx, url: url, queueingTime: time.Now(), options: options}
 		jobs <- job
 	}
 	close(jobs)
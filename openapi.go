@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// docsPage renders /openapi.json and sends requests to the API, it is
+// self-contained (no third-party scripts or styles), so it works offline
+//
+//go:embed openapi_docs.html
+var docsPage []byte
+
+// docsPolicy is Content-Security-Policy of docsPage, the inline
+// script and style are allowed by their hashes
+var docsPolicy = newDocsPolicy(docsPage)
+
+// newDocsPolicy returns Content-Security-Policy of the page allowing
+// its inline scripts and styles only
+func newDocsPolicy(page []byte) string {
+	hashes := func(tag string) string {
+		s := []string{}
+		for _, m := range regexp.MustCompile(`(?s)<`+tag+`>(.*?)</`+tag+`>`).FindAllSubmatch(page, -1) {
+			hash := sha256.Sum256(m[1])
+			s = append(s, "'sha256-"+base64.StdEncoding.EncodeToString(hash[:])+"'")
+		}
+		return strings.Join(s, " ")
+	}
+	return "default-src 'none'; script-src " + hashes("script") + "; style-src " + hashes("style") +
+		"; connect-src 'self'; base-uri 'none'; form-action 'none'"
+}
+
+// jsonObject is a node of OpenAPI document
+type jsonObject = map[string]interface{}
+
+// apiParam describes query or header parameter of an operation
+// (path parameters are taken from the handler path)
+type apiParam struct {
+	Name        string
+	In          string // query or header
+	Type        string // JSON schema type
+	Description string
+}
+
+// apiOperation is the spec entry of a handler
+type apiOperation struct {
+	Summary     string
+	Description string
+	Params      []apiParam
+	Request     interface{}         // request body example of the type (nil - no body)
+	Responses   map[int]interface{} // success responses, value is body of the type (nil - no body)
+	Produces    string              // content type of success responses (default - application/json)
+	Errors      []int               // statuses of ErrorResponse besides ones implied by the handler flags
+}
+
+// apiOperations are spec entries of RESTHandlers by "METHOD path",
+// every handler should have one
+var apiOperations = map[string]apiOperation{
+	"GET /": {
+		Summary:   "List registered endpoints",
+		Responses: map[int]interface{}{http.StatusOK: []restHandler{}},
+	},
+	"POST /api/v1/parse": {
+		Summary: "Parse a message",
+		Description: "Extracts mentions, emoticons and links of the message and fetches link titles. " +
+			"Send Accept: application/x-ndjson or text/event-stream to stream link results as they are fetched, " +
+			"?async=true or Prefer: respond-async (or callback_url) to get a job right away.",
+		Params: []apiParam{
+			{"async", "query", "boolean", "process the message in background"},
+			{"strict", "query", "boolean", "reject unknown fields"},
+			{"Prefer", "header", "string", "respond-async processes the message in background"},
+			{"If-None-Match", "header", "string", "ETag of the result the client has already, 304 is returned once the request is processed (deliberately not 412 of RFC 9110)"},
+		},
+		Request: IM{},
+		Responses: map[int]interface{}{
+			http.StatusOK:          ServiceResponse{},
+			http.StatusAccepted:    JobResponse{},
+			http.StatusNotModified: nil,
+		},
+		Errors: []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity},
+	},
+	"POST /api/v1/parse/batch": {
+		Summary:     "Parse a batch of messages",
+		Description: "Each distinct link of the batch is fetched once, results are in the input order.",
+		Params: []apiParam{
+			{"strict", "query", "boolean", "reject unknown fields"},
+			{"If-None-Match", "header", "string", "ETag of the result the client has already, 304 is returned once the request is processed (deliberately not 412 of RFC 9110)"},
+		},
+		Request: BatchIM{},
+		Responses: map[int]interface{}{
+			http.StatusOK:          BatchResponse{},
+			http.StatusNotModified: nil,
+		},
+		Errors: []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity},
+	},
+	"GET /api/v1/jobs/{id}": {
+		Summary:   "Get state of an asynchronous parsing job",
+		Responses: map[int]interface{}{http.StatusOK: JobResponse{}},
+		Errors:    []int{http.StatusNotFound},
+	},
+	"GET /api/v1/ws": {
+		Summary: "Parse message drafts interactively over WebSocket",
+		Description: "Client sends WSDraft messages, server replies with EntitiesEvent, LinkEvent, DoneEvent " +
+			"and ErrorEvent messages tagged with the draft seq. " +
+			"Browsers pass the API key as \"api-key.<base64url key>\" subprotocol along with \"parser\".",
+		Params: []apiParam{
+			{"Sec-WebSocket-Protocol", "header", "string", "parser (and api-key.<base64url key>)"},
+		},
+		Responses: map[int]interface{}{http.StatusSwitchingProtocols: nil},
+	},
+	"GET /bulktest": {
+		Summary:   "Fetch titles of popular sites",
+		Responses: map[int]interface{}{http.StatusOK: ""},
+		Produces:  "text/html",
+	},
+	"GET /selftest": {
+		Summary:   "Parse a sample message through the API",
+		Responses: map[int]interface{}{http.StatusOK: ""},
+		Produces:  "text/html",
+	},
+	"GET /healthz": {
+		Summary:   "Liveness probe",
+		Responses: map[int]interface{}{http.StatusOK: HealthResponse{}},
+		Errors:    []int{http.StatusServiceUnavailable},
+	},
+	"GET /readyz": {
+		Summary:   "Readiness probe",
+		Responses: map[int]interface{}{http.StatusOK: HealthResponse{}},
+		Errors:    []int{http.StatusServiceUnavailable},
+	},
+	"GET /debug/vars": {
+		Summary:   "Runtime status and instrumentation",
+		Responses: map[int]interface{}{http.StatusOK: map[string]interface{}{}},
+	},
+	"GET /openapi.json": {
+		Summary:   "OpenAPI specification of the service",
+		Responses: map[int]interface{}{http.StatusOK: map[string]interface{}{}},
+	},
+	"GET /docs": {
+		Summary:   "Interactive API documentation",
+		Responses: map[int]interface{}{http.StatusOK: ""},
+		Produces:  "text/html",
+	},
+}
+
+// schemaEnums are allowed values of "Type.field" schemas
+// (of array items for arrays)
+var schemaEnums = map[string][]string{
+	"URLResponse.status": {linkPending, linkOK, linkNoTitle, linkDNSError, linkTimeout, linkConnectionError,
+		linkHTTPError, linkBlocked, linkTooLarge, linkNotHTML, linkInvalidURL, linkTooManyRedirect,
+		linkInsecureRedirect, linkDisallowed, linkFTPError, linkCanceled, linkSkipped},
+	"ParseOptions.entities": entityTypes,
+	"ParseOptions.fields":   linkFields,
+	"HealthResponse.status": {healthOK, healthFail},
+	"HealthCheck.status":    {healthOK, healthFail},
+}
+
+// openAPI is generated once, RESTHandlers do not change at runtime
+var openAPI struct {
+	once sync.Once
+	doc  []byte
+}
+
+// doOpenAPIHandler serves OpenAPI specification of RESTHandlers
+func doOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	openAPI.once.Do(func() {
+		var err error
+		if openAPI.doc, err = json.MarshalIndent(newOpenAPIDoc(RESTHandlers), "", "  "); err != nil {
+			Error.Println(requestID(r), err)
+		}
+	})
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPI.doc)
+}
+
+// doDocsHandler serves interactive documentation of the API
+func doDocsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("Content-Security-Policy", docsPolicy)
+	w.WriteHeader(http.StatusOK)
+	w.Write(docsPage)
+}
+
+// newOpenAPIDoc generates OpenAPI document of the handlers
+func newOpenAPIDoc(handlers []restHandler) jsonObject {
+	schemas := jsonObject{}
+	paths := jsonObject{}
+	for _, h := range handlers {
+		item, ok := paths[h.Path].(jsonObject)
+		if !ok {
+			item = jsonObject{}
+			paths[h.Path] = item
+		}
+		item[strings.ToLower(h.Method)] = newOpenAPIOperation(h, apiOperations[h.Method+" "+h.Path], schemas)
+	}
+
+	return jsonObject{
+		"openapi": "3.1.0",
+		"info": jsonObject{
+			"title":       "Parser API",
+			"description": "Extracts mentions, emoticons and links (with titles) of chat messages",
+			"version":     "1.0.0",
+		},
+		"paths": paths,
+		"components": jsonObject{
+			"schemas": schemas,
+			"securitySchemes": jsonObject{
+				"bearer": jsonObject{"type": "http", "scheme": "bearer", "description": "API key (required with -api-keys)"},
+				"apiKey": jsonObject{"type": "apiKey", "in": "header", "name": "X-API-Key", "description": "API key (required with -api-keys)"},
+			},
+		},
+	}
+}
+
+// newOpenAPIOperation generates operation object of the handler,
+// responses implied by the handler flags are added to spec entry ones
+func newOpenAPIOperation(h restHandler, op apiOperation, schemas jsonObject) jsonObject {
+	operation := jsonObject{
+		"operationId": operationID(h),
+		"summary":     op.Summary,
+	}
+	if op.Description != "" {
+		operation["description"] = op.Description
+	}
+
+	params := []jsonObject{}
+	for _, s := range splitPath(h.Path) {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			params = append(params, jsonObject{"name": s[1 : len(s)-1], "in": "path", "required": true, "schema": jsonObject{"type": "string"}})
+		}
+	}
+	params = append(params, jsonObject{"name": requestIDHeader, "in": "header", "schema": jsonObject{"type": "string", "pattern": requestIDPattern.String()},
+		"description": "id of the request (generated if not set), returned in responses, logs and error envelopes"})
+	for _, p := range op.Params {
+		param := jsonObject{"name": p.Name, "in": p.In, "schema": jsonObject{"type": p.Type}}
+		if p.Description != "" {
+			param["description"] = p.Description
+		}
+		params = append(params, param)
+	}
+	if len(params) > 0 {
+		operation["parameters"] = params
+	}
+
+	if op.Request != nil {
+		operation["requestBody"] = jsonObject{
+			"required": true,
+			"content": jsonObject{
+				"application/json": jsonObject{"schema": schemaOf(reflect.TypeOf(op.Request), schemas)},
+			},
+		}
+	}
+
+	produces := op.Produces
+	if produces == "" {
+		produces = "application/json"
+	}
+	responses := jsonObject{}
+	for status, body := range op.Responses {
+		response := jsonObject{"description": http.StatusText(status)}
+		if body != nil {
+			response["content"] = jsonObject{produces: jsonObject{"schema": schemaOf(reflect.TypeOf(body), schemas)}}
+		}
+		responses[strconv.Itoa(status)] = response
+	}
+	errors := append([]int{}, op.Errors...)
+	if h.Scope != "" {
+		errors = append(errors, http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests)
+		operation["security"] = []jsonObject{{"bearer": []string{h.Scope}}, {"apiKey": []string{h.Scope}}}
+	}
+	if !h.Probe {
+		errors = append(errors, http.StatusTooManyRequests)
+	}
+	if h.Heavy {
+		errors = append(errors, http.StatusServiceUnavailable)
+	}
+	for _, status := range errors {
+		if _, ok := responses[strconv.Itoa(status)]; ok {
+			continue
+		}
+		schema := schemaOf(reflect.TypeOf(ErrorResponse{}), schemas)
+		if h.Probe {
+			schema = schemaOf(reflect.TypeOf(HealthResponse{}), schemas)
+		}
+		responses[strconv.Itoa(status)] = jsonObject{
+			"description": http.StatusText(status),
+			"content":     jsonObject{"application/json": jsonObject{"schema": schema}},
+		}
+	}
+	operation["responses"] = responses
+	return operation
+}
+
+// operationID generates id of the operation by its handler name
+// (e.g. "doParsingHandler" => "parsing")
+func operationID(h restHandler) string {
+	name := getFunctionName(h.Handler)
+	name = name[strings.LastIndex(name, ".")+1:]
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "do"), "Handler")
+	if name == "" {
+		return strings.ToLower(h.Method)
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf generates JSON schema of the type, named structs are added
+// to schemas and referenced
+func schemaOf(t reflect.Type, schemas jsonObject) jsonObject {
+	switch {
+	case t == timeType:
+		return jsonObject{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		return schemaOf(t.Elem(), schemas)
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = nil // placeholder breaks recursion
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return jsonObject{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Struct:
+		return structSchema(t, schemas)
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return jsonObject{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	}
+	return jsonObject{} // interface{} - any value
+}
+
+// structSchema generates object schema of the struct by its json tags,
+// fields without omitempty are required
+func structSchema(t reflect.Type, schemas jsonObject) jsonObject {
+	properties := jsonObject{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		name, options := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, options = tag[:i], tag[i:]
+		}
+		// fields of embedded structs are inlined
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			embedded := structSchema(f.Type, schemas)
+			for n, p := range embedded["properties"].(jsonObject) {
+				properties[n] = p
+			}
+			if r, ok := embedded["required"].([]string); ok {
+				required = append(required, r...)
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		schema := schemaOf(f.Type, schemas)
+		if enum, ok := schemaEnums[t.Name()+"."+name]; ok {
+			if items, ok := schema["items"].(jsonObject); ok {
+				items["enum"] = enum
+			} else {
+				schema["enum"] = enum
+			}
+		}
+		properties[name] = schema
+		if !strings.Contains(options, ",omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := jsonObject{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entity types that can be extracted from a message
+const (
+	entityMentions  = "mentions"
+	entityEmoticons = "emoticons"
+	entityLinks     = "links"
+)
+
+var entityTypes = []string{entityMentions, entityEmoticons, entityLinks}
+
+// linkFields are json names of URLResponse fields a client can select,
+// url is always returned
+var linkFields = []string{"url", "title", "status", "status_code", "final_url",
+	"canonical_url", "redirects", "ftp", "message", "attempts"}
+
+// languagePattern matches a single Accept-Language item (e.g. "en-US;q=0.8")
+var languagePattern = regexp.MustCompile(`^(\*|[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*)(\s*;\s*q=(0(\.\d{0,3})?|1(\.0{0,3})?))?$`)
+
+// ParseOptions customizes parsing of a single message,
+// zero value (or no options at all) means defaults
+type ParseOptions struct {
+	Entities   []string `json:"entities,omitempty"`    // entity types to extract (default - all)
+	FetchLinks *bool    `json:"fetch_links,omitempty"` // whether to fetch links (default - true)
+	MaxLinks   int      `json:"max_links,omitempty"`   // max # of distinct links to fetch (0 - no limit)
+	TimeoutMS  int      `json:"timeout_ms,omitempty"`  // max time to fetch a link, capped by fetchTimeout
+	Language   string   `json:"language,omitempty"`    // Accept-Language of link requests
+	Fields     []string `json:"fields,omitempty"`      // link fields to return (default - all)
+}
+
+// fetchOptions are per-request settings of link fetching
+type fetchOptions struct {
+	timeout  time.Duration // overrides fetchTimeout if shorter (0 - not set)
+	language string        // overrides Accept-Language (empty - not set)
+}
+
+// optionError creates error of an invalid option
+func optionError(option, message string, allowed []string) *apiError {
+	err := newAPIError(http.StatusUnprocessableEntity, "invalid_option", message)
+	details := map[string]interface{}{"option": option}
+	if allowed != nil {
+		details["allowed"] = allowed
+	}
+	err.details = details
+	return err
+}
+
+// contains reports whether the list contains the value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks all the options, nil options are valid
+func (o *ParseOptions) validate() *apiError {
+	if o == nil {
+		return nil
+	}
+	for _, e := range o.Entities {
+		if !contains(entityTypes, e) {
+			return optionError("entities", "unknown entity type "+e, entityTypes)
+		}
+	}
+	if o.MaxLinks < 0 {
+		return optionError("max_links", "max_links should not be negative", nil)
+	}
+	if o.TimeoutMS < 0 {
+		return optionError("timeout_ms", "timeout_ms should not be negative", nil)
+	}
+	if o.Language != "" {
+		for _, l := range strings.Split(o.Language, ",") {
+			if !languagePattern.MatchString(strings.TrimSpace(l)) {
+				return optionError("language", "language should be a list of language tags (e.g. \"en-US, en;q=0.8\")", nil)
+			}
+		}
+	}
+	for _, f := range o.Fields {
+		if !contains(linkFields, f) {
+			return optionError("fields", "unknown link field "+f, linkFields)
+		}
+	}
+	return nil
+}
+
+// extracts reports whether the entity type should be extracted
+func (o *ParseOptions) extracts(entity string) bool {
+	return o == nil || len(o.Entities) == 0 || contains(o.Entities, entity)
+}
+
+// linksToFetch returns distinct links of the message to be fetched
+func (o *ParseOptions) linksToFetch(links []string) []string {
+	if !o.extracts(entityLinks) || (o != nil && o.FetchLinks != nil && !*o.FetchLinks) {
+		return []string{}
+	}
+	unique := uniqueLinks(links)
+	if o != nil && o.MaxLinks > 0 && len(unique) > o.MaxLinks {
+		unique = unique[:o.MaxLinks]
+	}
+	return unique
+}
+
+// fetchOptions returns settings of link fetching
+func (o *ParseOptions) fetchOptions() fetchOptions {
+	if o == nil {
+		return fetchOptions{}
+	}
+	options := fetchOptions{language: o.Language}
+	if timeout := time.Duration(o.TimeoutMS) * time.Millisecond; timeout < fetchTimeout {
+		options.timeout = timeout
+	}
+	return options
+}
+
+// apply drops entities that are not requested and
+// restricts links to the requested fields
+func (o *ParseOptions) apply(response ServiceResponse) ServiceResponse {
+	if !o.extracts(entityMentions) {
+		response.Mentions = []string{}
+	}
+	if !o.extracts(entityEmoticons) {
+		response.Emoticons = []string{}
+	}
+	if !o.extracts(entityLinks) {
+		response.Links = []URLResponse{}
+	}
+	for i := range response.Links {
+		response.Links[i] = o.applyLink(response.Links[i])
+	}
+	return response
+}
+
+// applyLink restricts the link to the requested fields
+func (o *ParseOptions) applyLink(link URLResponse) URLResponse {
+	if o != nil && len(o.Fields) > 0 {
+		link.fields = o.Fields
+	}
+	return link
+}
+
+// MarshalJSON encodes only the selected fields (if any) of the link,
+// fields are encoded in the struct order, "url" is always included
+func (l URLResponse) MarshalJSON() ([]byte, error) {
+	type urlResponse URLResponse // same fields, no MarshalJSON
+	if l.fields == nil {
+		return json.Marshal(urlResponse(l))
+	}
+
+	v := reflect.ValueOf(l)
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		name := tag[0]
+		if !field.IsExported() || (name != "url" && !contains(l.fields, name)) {
+			continue
+		}
+		value := v.Field(i)
+		if contains(tag[1:], "omitempty") && isEmptyJSONValue(value) {
+			continue
+		}
+		data, err := json.Marshal(value.Interface())
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strconv.Quote(name))
+		buf.WriteByte(':')
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// isEmptyJSONValue reports whether the value is omitted by omitempty
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
@@ -1,7 +1,27 @@
 // Parser contains the following modules
 // REST API: restapi.go
+// OpenAPI specification and docs page: openapi.go, openapi_docs.html
+// TLS and HTTP/2 serving: tls.go
+// Response compression and conditional requests: compression.go
+// API keys and quotas: auth.go
+// Inbound rate limiting and load shedding: ratelimit.go
+// gRPC API: grpc_server.go, parserpb/parser.proto
+// Batch parsing: batch.go
+// Asynchronous parsing jobs and webhooks: jobs.go
+// Streaming of parsing results (NDJSON/SSE): stream.go
+// Interactive parsing over WebSocket: websocket.go
+// Routing: router.go
+// CORS: cors.go
+// Error envelope and request decoding: api_errors.go
 // Message parsing: message_processing.go
+// Per-request parsing options: options.go
 // Loggin: logger.go
+// Per-host circuit breakers: circuit_breaker.go
+// Outgoing HTTP client configuration: fetch_client.go
+// robots.txt and opt-out handling: robots.go
+// FTP links processing: ftp.go
+// Graceful shutdown: shutdown.go
+// Liveness and readiness probes: health.go
 // Synchronization and Insrumentation: sync_and_instrumentation.go
 //   /debug/vars - for runtime status
 // Testing:
@@ -18,35 +38,279 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"sync"
+	"time"
+
+	"google.golang.org/grpc"
 )
 
 // address and port to listen to
 var serviceAddr = "127.0.0.1:8000"
 
+// TLS certificate and key files of the API (empty - plain HTTP)
+var tlsCertFile, tlsKeyFile string
+
+// file with CAs client certificates are verified against (empty - no mTLS)
+var tlsClientCAFile string
+
+// client certificate verification mode: none, request (if given) or require
+var tlsClientAuth = "require"
+
+// min size of response body to compress (negative disables compression)
+var compressMinSize = 1024
+
+// file with API keys (empty disables authentication)
+var apiKeysFile string
+
+// # of requests per second a single client IP may send (0 - unlimited)
+var rateLimit float64
+
+// # of requests a single client IP may send at once
+var rateBurst = 20
+
+// proxies X-Forwarded-For/X-Real-IP headers are trusted from
+var trustedProxies ipNets
+
+// max number of parsing requests processed concurrently (0 - unlimited)
+var maxInFlight = 500
+
+// parsing requests are rejected while a fetch waits for
+// a free connection longer than that (0 - never)
+var shedQueueWait = 5 * time.Second
+
+// max time a client may take to send request headers
+var readHeaderTimeout = 10 * time.Second
+
+// time an idle keep-alive connection of a client is kept open
+var idleTimeout = 2 * time.Minute
+
+// max time to wait for requests and fetches in progress on shutdown
+var drainTimeout = 30 * time.Second
+
+// time /readyz reports not ready before listeners are closed on shutdown
+var drainDelay = 5 * time.Second
+
+// comma-separated urls fetched on startup before the service is ready
+var warmupURLs string
+
+// host resolved by readiness probe (empty - no DNS check)
+var readyDNSHost string
+
+// address and port gRPC API listens to (empty disables gRPC API)
+var grpcAddr = "127.0.0.1:8001"
+
 // number of simultanious outgoing HTTP(S) connections
 var maxHTTPconnections = 100
 
+// number of simultanious outgoing HTTP(S) connections to a single host
+// (0 means no per-host limit, only the global one is applied)
+var maxHTTPconnectionsPerHost = 10
+
+// minimum delay between two consecutive requests to the same host
+var minHostDelay time.Duration
+
+// number of consecutive failures within breakerWindow that opens
+// host's circuit breaker (0 disables circuit breakers)
+var breakerFailures = 5
+
+// time window consecutive failures are counted within
+var breakerWindow = time.Minute
+
+// time an open breaker fails requests fast before letting a probe through
+var breakerCooldown = 30 * time.Second
+
+// max time to fetch a single link (incl. all retries)
+var fetchTimeout = 10 * time.Second
+
+// max number of retries of transient fetch failures
+var fetchRetries = 2
+
+// delay before the first retry, it doubles for every next one
+var retryBaseDelay = 200 * time.Millisecond
+
+// upper limit of the delay between two retries
+var retryMaxDelay = 5 * time.Second
+
+// max number of redirects to follow for a single link
+var maxRedirects = 10
+
+// whether redirects from https to http are followed
+var allowHTTPSDowngrade = false
+
+// whether robots.txt, X-Robots-Tag and meta robots are respected
+var respectRobots = false
+
+// time robots.txt policy of a host is cached for
+var robotsCacheTTL = time.Hour
+
+// time robots.txt of a host is not fetched again after a failed fetch
+var robotsRetryTTL = time.Minute
+
+// max number of messages in a single batch
+var maxBatchSize = 100
+
+// max number of links (incl. duplicates) in all messages of a single batch
+var maxBatchLinks = 1000
+
+// time a finished async job is kept for polling
+var jobTTL = time.Hour
+
+// max number of async jobs kept (running and finished ones)
+var maxJobs = 1000
+
+// secret webhooks are signed with (empty disables callbacks)
+var webhookSecret string
+
+// max number of retries of a failed webhook delivery
+var webhookRetries = 5
+
+// comma-separated hosts callbacks may be delivered to even if internal
+var webhookAllowHosts string
+
 func init() {
-	// process cmd-line flags (if any)
-	serviceAddr = *flag.String("addr", serviceAddr, "specify addr:port the server should listen on")
-	maxHTTPconnections = *flag.Int("max-http-req", maxHTTPconnections, "specify max number of outgoing concurrent http requests")
-	flag.Parse()
+	// register cmd-line flags, they are parsed in main
+	flag.StringVar(&serviceAddr, "addr", serviceAddr, "specify addr:port the server should listen on")
+	flag.StringVar(&tlsCertFile, "tls-cert", tlsCertFile, "specify PEM certificate file to serve HTTPS/HTTP2 with (reloaded on change)")
+	flag.StringVar(&tlsKeyFile, "tls-key", tlsKeyFile, "specify PEM private key file of -tls-cert")
+	flag.StringVar(&tlsClientCAFile, "tls-client-ca", tlsClientCAFile, "specify PEM file with CAs to verify client certificates against (empty - no mTLS)")
+	flag.StringVar(&tlsClientAuth, "tls-client-auth", tlsClientAuth, "specify client certificate verification: none, request (verify if given), require")
+	flag.IntVar(&compressMinSize, "compress-min-size", compressMinSize, "specify min size of response body to compress with gzip, zstd or brotli (negative - no compression)")
+	flag.StringVar(&corsConfig.origins, "cors-origins", corsConfig.origins, "specify comma-separated origins browsers may call the API from, * or https://*.example.com for subdomains (empty - CORS disabled)")
+	flag.StringVar(&corsConfig.methods, "cors-methods", corsConfig.methods, "specify comma-separated methods allowed for cross-origin requests (empty - all methods of the endpoint)")
+	flag.StringVar(&corsConfig.headers, "cors-headers", corsConfig.headers, "specify comma-separated request headers allowed for cross-origin requests")
+	flag.BoolVar(&corsConfig.credentials, "cors-credentials", corsConfig.credentials, "allow cross-origin requests with credentials")
+	flag.DurationVar(&corsConfig.maxAge, "cors-max-age", corsConfig.maxAge, "specify time browsers may cache preflight responses for (0 - not set)")
+	flag.StringVar(&apiKeysFile, "api-keys", apiKeysFile, "specify json file with API keys (empty - authentication disabled)")
+	flag.Float64Var(&rateLimit, "rate-limit", rateLimit, "specify # of requests per second a single client IP may send (0 - unlimited)")
+	flag.IntVar(&rateBurst, "rate-burst", rateBurst, "specify # of requests a single client IP may send at once")
+	flag.Var(&trustedProxies, "trusted-proxies", "specify comma-separated IPs/CIDRs of proxies X-Forwarded-For is trusted from")
+	flag.IntVar(&maxInFlight, "max-in-flight", maxInFlight, "specify max # of parsing requests processed concurrently (0 - unlimited)")
+	flag.DurationVar(&shedQueueWait, "shed-queue-wait", shedQueueWait, "specify fetch queue wait parsing requests are rejected with 503 after (0 - never)")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", readHeaderTimeout, "specify max time a client may take to send request headers")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout, "specify time an idle client connection is kept open")
+	flag.DurationVar(&drainTimeout, "drain-timeout", drainTimeout, "specify max time to wait for requests and fetches in progress on shutdown")
+	flag.DurationVar(&drainDelay, "drain-delay", drainDelay, "specify time the service reports not ready before it stops accepting connections on shutdown")
+	flag.StringVar(&warmupURLs, "warmup-urls", warmupURLs, "specify comma-separated urls fetched on startup before the service is ready")
+	flag.StringVar(&readyDNSHost, "ready-dns-host", readyDNSHost, "specify host /readyz resolves to check DNS (empty - no DNS check)")
+	flag.StringVar(&grpcAddr, "grpc-addr", grpcAddr, "specify addr:port gRPC API should listen on (empty - disabled)")
+	flag.IntVar(&maxHTTPconnections, "max-http-req", maxHTTPconnections, "specify max number of outgoing concurrent http requests")
+	flag.IntVar(&maxHTTPconnectionsPerHost, "max-http-req-per-host", maxHTTPconnectionsPerHost, "specify max number of outgoing concurrent http requests to a single host (0 - unlimited)")
+	flag.DurationVar(&minHostDelay, "host-delay", minHostDelay, "specify min delay between consecutive requests to the same host")
+	flag.IntVar(&breakerFailures, "breaker-failures", breakerFailures, "specify # of consecutive failures that make a host temporarily unavailable (0 - disabled)")
+	flag.DurationVar(&breakerWindow, "breaker-window", breakerWindow, "specify time window consecutive host failures are counted within")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", breakerCooldown, "specify time a failing host is considered unavailable before it is probed again")
+	flag.DurationVar(&fetchTimeout, "fetch-timeout", fetchTimeout, "specify max time to fetch a single link (incl. retries)")
+	flag.IntVar(&fetchRetries, "fetch-retries", fetchRetries, "specify max # of retries of transient fetch failures")
+	flag.DurationVar(&retryBaseDelay, "retry-base-delay", retryBaseDelay, "specify delay before the first retry (doubles for every next one)")
+	flag.DurationVar(&retryMaxDelay, "retry-max-delay", retryMaxDelay, "specify max delay between two retries")
+	flag.IntVar(&maxRedirects, "max-redirects", maxRedirects, "specify max # of redirects to follow for a single link")
+	flag.BoolVar(&allowHTTPSDowngrade, "allow-https-downgrade", allowHTTPSDowngrade, "allow redirects from https to http")
+	flag.StringVar(&fetchConfig.proxy, "proxy", fetchConfig.proxy, "specify proxy url for outgoing requests (default - taken from HTTP_PROXY/HTTPS_PROXY)")
+	flag.StringVar(&fetchConfig.httpProxy, "http-proxy", fetchConfig.httpProxy, "specify proxy url for outgoing http requests")
+	flag.StringVar(&fetchConfig.httpsProxy, "https-proxy", fetchConfig.httpsProxy, "specify proxy url for outgoing https requests")
+	flag.StringVar(&fetchConfig.noProxy, "no-proxy", fetchConfig.noProxy, "specify comma-separated hosts, domains and CIDRs not to be proxied (default - taken from NO_PROXY)")
+	flag.StringVar(&fetchConfig.userAgent, "user-agent", fetchConfig.userAgent, "specify User-Agent of outgoing requests")
+	flag.StringVar(&fetchConfig.acceptLanguage, "accept-language", fetchConfig.acceptLanguage, "specify Accept-Language of outgoing requests")
+	flag.StringVar(&fetchConfig.requestIDHeader, "forward-request-id", fetchConfig.requestIDHeader, "specify header outgoing requests carry id of the API request in, e.g. X-Request-ID (empty - not forwarded)")
+	flag.Var(&fetchConfig.headers, "header", "specify extra 'Name: value' header of outgoing requests (repeatable)")
+	flag.StringVar(&fetchConfig.caBundle, "ca-bundle", fetchConfig.caBundle, "specify PEM file with extra CAs to trust")
+	flag.StringVar(&fetchConfig.tlsMinVersion, "tls-min-version", fetchConfig.tlsMinVersion, "specify min TLS version of outgoing requests (1.0, 1.1, 1.2, 1.3)")
+	flag.IntVar(&fetchConfig.maxIdleConns, "max-idle-conns", fetchConfig.maxIdleConns, "specify max # of idle outgoing connections")
+	flag.IntVar(&fetchConfig.maxIdleConnsPerHost, "max-idle-conns-per-host", fetchConfig.maxIdleConnsPerHost, "specify max # of idle outgoing connections per host")
+	flag.DurationVar(&fetchConfig.idleConnTimeout, "idle-conn-timeout", fetchConfig.idleConnTimeout, "specify time an idle outgoing connection is kept open")
+	flag.BoolVar(&respectRobots, "respect-robots", respectRobots, "respect robots.txt, X-Robots-Tag and meta robots of linked pages")
+	flag.DurationVar(&robotsCacheTTL, "robots-cache-ttl", robotsCacheTTL, "specify time robots.txt of a host is cached for")
+	flag.DurationVar(&robotsRetryTTL, "robots-retry-ttl", robotsRetryTTL, "specify time a failed robots.txt fetch is cached for")
+	flag.IntVar(&maxBatchSize, "max-batch-size", maxBatchSize, "specify max # of messages in a single batch")
+	flag.IntVar(&maxBatchLinks, "max-batch-links", maxBatchLinks, "specify max # of links in all messages of a single batch")
+	flag.DurationVar(&jobTTL, "job-ttl", jobTTL, "specify time a finished async job is kept for polling")
+	flag.IntVar(&maxJobs, "max-jobs", maxJobs, "specify max # of async jobs kept")
+	flag.StringVar(&webhookSecret, "webhook-secret", webhookSecret, "specify secret webhooks are signed with (empty - callbacks disabled)")
+	flag.IntVar(&webhookRetries, "webhook-retries", webhookRetries, "specify max # of retries of a failed webhook delivery")
+	flag.StringVar(&webhookAllowHosts, "webhook-allow-hosts", webhookAllowHosts, "specify comma-separated hosts callbacks may be delivered to even if they are internal (loopback, private etc.)")
 
 	// initialize global, will be used by all others routines in run-time
 	global = Global{
 		globalCounter:   0,
 		mutex:           &sync.Mutex{},
-		fetchInProgress: make(map[string]string, maxHTTPconnections),
+		fetchInProgress: make(map[string][]string, maxHTTPconnections),
 		processesLimit:  make(chan string, maxHTTPconnections),
 		expRequests:     expvar.NewString("requests"),
 		expCounter:      expvar.NewInt("counter"),
+		hosts:           make(map[string]*hostState),
+		expHostQueues:   expvar.NewMap("hostQueues"),
+		waiters:         make(map[int64]time.Time),
+	}
+	service = newLifecycle()
+	limiter = loadLimiter{
+		mutex:   &sync.Mutex{},
+		buckets: make(map[string]*tokenBucket),
+		expLoad: expvar.NewMap("load"),
+	}
+	apiKeys = apiKeyStore{
+		mutex:    &sync.Mutex{},
+		expUsage: expvar.NewMap("apiKeys"),
+	}
+	breakers = hostBreakers{
+		mutex:     &sync.Mutex{},
+		hosts:     make(map[string]*circuitBreaker),
+		expStates: expvar.NewMap("breakers"),
 	}
 }
 
 func main() {
+	flag.Parse()
+	// limits might be changed by cmd-line flags
+	global.processesLimit = make(chan string, maxHTTPconnections)
+	client, err := newFetchClient(fetchConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fetchClient = client
+	if webhookClient, err = newWebhookClient(fetchConfig); err != nil {
+		log.Fatal(err)
+	}
+	if cors, err = newCORSPolicy(corsConfig); err != nil {
+		log.Fatal(err)
+	}
+	if apiKeysFile != "" {
+		if err := apiKeys.load(apiKeysFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	logInit(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
-	log.Fatal(http.ListenAndServe(serviceAddr, nil))
+	go jobs.runJanitor()
+
+	tlsConfig, err := newServerTLSConfig(tlsCertFile, tlsKeyFile, tlsClientCAFile, tlsClientAuth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// no read/write timeouts, bodies are small and responses
+	// may be streamed (websocket connections are hijacked)
+	httpServer := &http.Server{
+		Addr:              serviceAddr,
+		Handler:           apiRouter,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	var grpcServer *grpc.Server
+	var grpcListener net.Listener
+	if grpcAddr != "" {
+		if grpcListener, err = net.Listen("tcp", grpcAddr); err != nil {
+			log.Fatal(err)
+		}
+		grpcServer = newGRPCServer(tlsConfig)
+		Info.Println("gRPC API listens on", grpcListener.Addr())
+	}
+	service.markStarted()
+	go warmUp(warmupURLs)
+	if err := service.run(httpServer, grpcServer, grpcListener); err != nil {
+		logFlush()
+		log.Fatal(err)
+	}
 }
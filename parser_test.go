@@ -1,14 +1,51 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/justanothergopher/parser/parserpb"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 type TestMatrix struct {
@@ -115,7 +152,7 @@ func TestFetchURL(t *testing.T) {
 		endProcessingTime:   time.Time{},
 	}
 
-	resp, err := fetchURL(job)
+	resp, err := fetchURL(context.Background(), job)
 	if err != nil {
 		t.Errorf("Error in %q(): %q\n", getFunctionName(fetchURL), err.Error())
 	} else {
@@ -156,7 +193,7 @@ func TestProcessFetchingJob(t *testing.T) {
 	close(ch)
 
 	if len(ch) != repeats {
-		t.Errorf("Error in %q() => %q results expect %q\n", getFunctionName(processFetchingJob), len(ch), repeats)
+		t.Errorf("Error in %q() => %d results expect %d\n", getFunctionName(processFetchingJob), len(ch), repeats)
 	}
 
 	// negative path
@@ -199,7 +236,7 @@ func TestProcessLinks(t *testing.T) {
 	defer ts.Close()
 	out := processLinks([]string{ts.URL})
 	if len(out) > 1 {
-		t.Errorf("Error in %q(%s) => %d result expect %q\n", getFunctionName(processLinks), ts.URL, len(out), 1)
+		t.Errorf("Error in %q(%s) => %d result expect %d\n", getFunctionName(processLinks), ts.URL, len(out), 1)
 	}
 	for result := range out {
 		/*d := result.endProcessingTime.Sub(result.startProcessingTime)
@@ -212,3 +249,2378 @@ func TestProcessLinks(t *testing.T) {
 	}
 
 }
+
+func TestHostLimits(t *testing.T) {
+	var mutex sync.Mutex
+	inProgress, maxInProgress := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inProgress++
+		if inProgress > maxInProgress {
+			maxInProgress = inProgress
+		}
+		mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mutex.Lock()
+		inProgress--
+		mutex.Unlock()
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+
+	defer func(limit int, delay time.Duration) {
+		maxHTTPconnectionsPerHost, minHostDelay = limit, delay
+	}(maxHTTPconnectionsPerHost, minHostDelay)
+	maxHTTPconnectionsPerHost, minHostDelay = 2, 0
+
+	links := []string{ts.URL + "/1", ts.URL + "/2", ts.URL + "/3", ts.URL + "/4", ts.URL + "/5", ts.URL + "/6"}
+	for range processLinks(links) {
+	}
+	if maxInProgress > maxHTTPconnectionsPerHost {
+		t.Errorf("Error in %q() => %d concurrent requests to a host, expect at most %d\n", getFunctionName(processLinks), maxInProgress, maxHTTPconnectionsPerHost)
+	}
+
+	// politeness delay
+	maxHTTPconnectionsPerHost, minHostDelay = 0, 20*time.Millisecond
+	start := time.Now()
+	for range processLinks(links[:3]) {
+	}
+	if d := time.Since(start); d < 2*minHostDelay {
+		t.Errorf("Error in %q() => 3 requests took %s, expect at least %s\n", getFunctionName(processLinks), d, 2*minHostDelay)
+	}
+	if global.expHostQueues.Get(hostOf(ts.URL)) != nil {
+		t.Errorf("Error in %q() => host queue is not empty after all requests are done\n", getFunctionName(processLinks))
+	}
+
+	// waiting for the host is given up once ctx is done
+	maxHTTPconnectionsPerHost, minHostDelay = 1, 0
+	host := "waiting.example.com"
+	if err := global.addHost(context.Background(), host); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := global.addHost(ctx, host); err != context.DeadlineExceeded {
+		t.Errorf("Error in %q() => %v, expect %v\n", getFunctionName(global.addHost), err, context.DeadlineExceeded)
+	}
+	global.removeHost(host)
+	global.mutex.Lock()
+	_, kept := global.hosts[host]
+	global.mutex.Unlock()
+	if kept || global.expHostQueues.Get(host) != nil {
+		t.Errorf("Error in %q() => state of %s is kept after all requests are done\n", getFunctionName(global.removeHost), host)
+	}
+
+	// idle hosts are dropped even if politeness delay was not over
+	// by the time their last request was done
+	global.mutex.Lock()
+	global.hosts[host] = &hostState{lastRequest: time.Now().Add(-time.Minute)}
+	global.dropIdleHosts(time.Now())
+	_, kept = global.hosts[host]
+	global.mutex.Unlock()
+	if kept {
+		t.Errorf("Error in %q() => idle state of %s is kept\n", getFunctionName(global.dropIdleHosts), host)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	failing := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+
+	defer func(failures int, cooldown time.Duration) {
+		breakerFailures, breakerCooldown = failures, cooldown
+	}(breakerFailures, breakerCooldown)
+	breakerFailures, breakerCooldown = 2, 50*time.Millisecond
+
+	host := hostOf(ts.URL)
+	job := &linkProcessingJob{url: ts.URL}
+
+	// failures caused by the caller say nothing about the host
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i <= breakerFailures; i++ {
+		if resp, err := fetchURL(canceled, job); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if state := breakers.expStates.Get(host); state != nil {
+		t.Errorf("Error in %q() => breaker is %s after canceled fetches, expect closed\n", getFunctionName(fetchURL), state)
+	}
+
+	for i := 0; i < breakerFailures; i++ {
+		if resp, err := fetchURL(context.Background(), job); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if _, err := fetchURL(context.Background(), job); err != errHostUnavailable {
+		t.Errorf("Error in %q() => %v, expect %v\n", getFunctionName(fetchURL), err, errHostUnavailable)
+	}
+	if state := breakers.expStates.Get(host).String(); state != `"open"` {
+		t.Errorf("Error in %q() => breaker is %s, expect %q\n", getFunctionName(fetchURL), state, breakerOpen)
+	}
+
+	// once cooldown is over a successful probe closes the breaker
+	failing = false
+	time.Sleep(breakerCooldown)
+	// the probe interrupted by the caller is released, not lost
+	if _, err := fetchURL(canceled, job); err == errHostUnavailable {
+		t.Errorf("Error in %q() => %v, expect probe to be allowed\n", getFunctionName(fetchURL), err)
+	}
+	resp, err := fetchURL(context.Background(), job)
+	if err != nil {
+		t.Fatalf("Error in %q() => %v, expect probe to be allowed\n", getFunctionName(fetchURL), err)
+	}
+	resp.Body.Close()
+	if breakers.allow(host) != true || breakers.expStates.Get(host) != nil {
+		t.Errorf("Error in %q() => breaker is not closed after successful probe\n", getFunctionName(fetchURL))
+	}
+}
+
+func TestCircuitBreakerCleanup(t *testing.T) {
+	defer func(failures int, window time.Duration) {
+		breakerFailures, breakerWindow = failures, window
+	}(breakerFailures, breakerWindow)
+	breakerFailures, breakerWindow = 3, 50*time.Millisecond
+
+	b := hostBreakers{
+		mutex:     &sync.Mutex{},
+		hosts:     make(map[string]*circuitBreaker),
+		expStates: new(expvar.Map),
+	}
+	for i := 0; i < 50; i++ {
+		b.report(fmt.Sprintf("host%d.example.com", i), false)
+	}
+	time.Sleep(2 * breakerWindow)
+	b.report("example.com", false)
+	if len(b.hosts) != 1 || b.expStates.Get("host0.example.com") != nil {
+		t.Errorf("Error in %q() => %d breakers kept, expect stale ones to be dropped\n", getFunctionName(b.report), len(b.hosts))
+	}
+
+	breakerWindow = time.Hour
+	for i := 0; i <= maxBreakers; i++ {
+		b.report(fmt.Sprintf("host%d.example.com", i), false)
+	}
+	if len(b.hosts) > maxBreakers {
+		t.Errorf("Error in %q() => %d breakers kept, expect at most %d\n", getFunctionName(b.report), len(b.hosts), maxBreakers)
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	var mutex sync.Mutex
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		calls++
+		n := calls
+		mutex.Unlock()
+		switch n {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			fmt.Fprintln(w, "<html><title>My title</title></html>")
+		}
+	}))
+	defer ts.Close()
+
+	defer func(retries int, delay time.Duration) {
+		fetchRetries, retryBaseDelay = retries, delay
+	}(fetchRetries, retryBaseDelay)
+	fetchRetries, retryBaseDelay = 2, time.Millisecond
+
+	for result := range processLinks([]string{ts.URL}) {
+		if result.title != "My title" || result.attempts != 3 {
+			t.Errorf("Error in %q() => %q after %d attempts, expect %q after %d\n", getFunctionName(processLinks), result.title, result.attempts, "My title", 3)
+		}
+	}
+
+	// no more retries than configured
+	fetchRetries = 0
+	for result := range processLinks([]string{ts.URL}) {
+		if result.attempts != 1 {
+			t.Errorf("Error in %q() => %d attempts, expect %d\n", getFunctionName(processLinks), result.attempts, 1)
+		}
+	}
+}
+
+var retryAfterTests = []struct {
+	in  string
+	out time.Duration
+	ok  bool
+}{
+	{"", 0, false},
+	{"3", 3 * time.Second, true},
+	{"-1", 0, false},
+	{"Wed, 21 Oct 2015 07:28:00 GMT", 0, true},
+	{"soon", 0, false},
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, test := range retryAfterTests {
+		d, ok := parseRetryAfter(test.in)
+		if d != test.out || ok != test.ok {
+			t.Errorf("%q(%q) => %s, %t, expect %s, %t", getFunctionName(parseRetryAfter), test.in, d, ok, test.out, test.ok)
+		}
+	}
+}
+
+func TestLinkStatus(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	})
+	mux.HandleFunc("/notitle", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "<html><body>no title</body></html>")
+	})
+	mux.HandleFunc("/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"title": "My title"}`)
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><body>", strings.Repeat("x", maxPageSize), "<title>My title</title></body></html>")
+	})
+	mux.HandleFunc("/large-length", func(w http.ResponseWriter, r *http.Request) {
+		page := "<html><title>My title</title><body>" + strings.Repeat("x", maxPageSize) + "</body></html>"
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		fmt.Fprint(w, page)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		url        string
+		status     string
+		title      string
+		statusCode int
+		finalURL   string
+	}{
+		{ts.URL + "/ok", linkOK, "My title", http.StatusOK, ts.URL + "/ok"},
+		{ts.URL + "/redirect", linkOK, "My title", http.StatusOK, ts.URL + "/ok"},
+		{ts.URL + "/notitle", linkNoTitle, "", http.StatusOK, ts.URL + "/notitle"},
+		{ts.URL + "/json", linkNotHTML, "", http.StatusOK, ts.URL + "/json"},
+		{ts.URL + "/large", linkTooLarge, "", http.StatusOK, ts.URL + "/large"},
+		{ts.URL + "/large-length", linkOK, "My title", http.StatusOK, ts.URL + "/large-length"},
+		{ts.URL + "/missing", linkHTTPError, "", http.StatusNotFound, ts.URL + "/missing"},
+	}
+	for _, test := range tests {
+		for r := range processLinks([]string{test.url}) {
+			if r.status != test.status || r.title != test.title || r.statusCode != test.statusCode || r.finalURL != test.finalURL {
+				t.Errorf("%q(%q) => %q %q %d %q, expect %q %q %d %q", getFunctionName(processLinks), test.url,
+					r.status, r.title, r.statusCode, r.finalURL, test.status, test.title, test.statusCode, test.finalURL)
+			}
+		}
+	}
+
+	defer func(timeout time.Duration) { fetchTimeout = timeout }(fetchTimeout)
+	fetchTimeout = 100 * time.Millisecond
+	for r := range processLinks([]string{ts.URL + "/slow"}) {
+		if r.status != linkTimeout {
+			t.Errorf("%q(%q) => %q, expect %q", getFunctionName(processLinks), ts.URL+"/slow", r.status, linkTimeout)
+		}
+	}
+}
+
+var fetchErrorTests = []struct {
+	in  error
+	out string
+}{
+	{errHostUnavailable, linkBlocked},
+	{&invalidURLError{fmt.Errorf("bad url")}, linkInvalidURL},
+	{fmt.Errorf("get: %w", &net.DNSError{Err: "no such host", Name: "xyz"}), linkDNSError},
+	{context.DeadlineExceeded, linkTimeout},
+	{fmt.Errorf("connection refused"), linkConnectionError},
+}
+
+func TestClassifyFetchError(t *testing.T) {
+	for _, test := range fetchErrorTests {
+		if status, _ := classifyFetchError(test.in); status != test.out {
+			t.Errorf("%q(%q) => %q, expect %q", getFunctionName(classifyFetchError), test.in, status, test.out)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/short", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/moved", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/page?utm=1", http.StatusFound)
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `<html><head><title>My title</title><link rel="Canonical" href="/page"></head></html>`)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for r := range processLinks([]string{ts.URL + "/short"}) {
+		expect := []redirectHop{{ts.URL + "/short", http.StatusMovedPermanently}, {ts.URL + "/moved", http.StatusFound}}
+		if r.status != linkOK || r.finalURL != ts.URL+"/page?utm=1" || r.canonicalURL != ts.URL+"/page" || fmt.Sprint(r.redirects) != fmt.Sprint(expect) {
+			t.Errorf("%q(%q) => %q %q %q %v, expect %q %q %q %v", getFunctionName(processLinks), ts.URL+"/short",
+				r.status, r.finalURL, r.canonicalURL, r.redirects, linkOK, ts.URL+"/page?utm=1", ts.URL+"/page", expect)
+		}
+	}
+
+	defer func(max int) { maxRedirects = max }(maxRedirects)
+	maxRedirects = 3
+	for r := range processLinks([]string{ts.URL + "/loop"}) {
+		if r.status != linkTooManyRedirect || len(r.redirects) != maxRedirects+1 {
+			t.Errorf("%q(%q) => %q after %d redirects, expect %q after %d", getFunctionName(processLinks), ts.URL+"/loop",
+				r.status, len(r.redirects), linkTooManyRedirect, maxRedirects+1)
+		}
+	}
+}
+
+func TestHTTPSDowngrade(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, plain.URL, http.StatusFound)
+	}))
+	defer secure.Close()
+
+	defer func(transport http.RoundTripper) { fetchClient.Transport = transport }(fetchClient.Transport)
+	fetchClient.Transport = secure.Client().Transport
+
+	for r := range processLinks([]string{secure.URL}) {
+		if r.status != linkInsecureRedirect {
+			t.Errorf("%q(%q) => %q, expect %q", getFunctionName(processLinks), secure.URL, r.status, linkInsecureRedirect)
+		}
+	}
+
+	defer func(allow bool) { allowHTTPSDowngrade = allow }(allowHTTPSDowngrade)
+	allowHTTPSDowngrade = true
+	for r := range processLinks([]string{secure.URL}) {
+		if r.status != linkOK || r.finalURL != plain.URL {
+			t.Errorf("%q(%q) => %q %q, expect %q %q", getFunctionName(processLinks), secure.URL, r.status, r.finalURL, linkOK, plain.URL)
+		}
+	}
+}
+
+func TestNewFetchClient(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", r.UserAgent(), r.Header.Get("Accept-Language"), r.Header.Get("X-Test"))
+	}))
+	defer ts.Close()
+
+	// trust test server's self-signed certificate
+	caBundle, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caBundle.Name())
+	pem.Encode(caBundle, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	caBundle.Close()
+
+	config := fetchClientConfig{
+		userAgent:      "test-agent",
+		acceptLanguage: "en",
+		headers:        headerFlags{"X-Test: 1"},
+		caBundle:       caBundle.Name(),
+		tlsMinVersion:  "1.2",
+	}
+	client, err := newFetchClient(config)
+	if err != nil {
+		t.Fatalf("Error in %q() => %v\n", getFunctionName(newFetchClient), err)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Error in %q() => %v\n", getFunctionName(newFetchClient), err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "test-agent|en|1" {
+		t.Errorf("Error in %q() => headers %q, expect %q\n", getFunctionName(newFetchClient), b, "test-agent|en|1")
+	}
+
+	// requests are routed through proxy unless host is in no-proxy list
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "proxied "+r.URL.Host)
+	}))
+	defer proxy.Close()
+	config.proxy = proxy.URL
+	client, _ = newFetchClient(config)
+	resp, err = client.Get("http://example.invalid/")
+	if err != nil {
+		t.Fatalf("Error in %q() => %v\n", getFunctionName(newFetchClient), err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "proxied example.invalid" {
+		t.Errorf("Error in %q() => %q, expect %q\n", getFunctionName(newFetchClient), b, "proxied example.invalid")
+	}
+	config.noProxy = ".invalid"
+	client, _ = newFetchClient(config)
+	if resp, err := client.Get("http://example.invalid/"); err == nil {
+		resp.Body.Close()
+		t.Errorf("Error in %q() => request is proxied despite no-proxy\n", getFunctionName(newFetchClient))
+	}
+
+	config.tlsMinVersion = "0.9"
+	if _, err := newFetchClient(config); err == nil {
+		t.Errorf("Error in %q() => no error for TLS version %q\n", getFunctionName(newFetchClient), config.tlsMinVersion)
+	}
+}
+
+func TestRobots(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		// the most specific group applies only
+		fmt.Fprintf(w, "User-agent: *\nDisallow: /\n\nUser-agent: %s\nDisallow: /private\nDisallow: /nopreview\n", robotsAgent())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	})
+	mux.HandleFunc("/header", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", robotsAgent()+": nosnippet")
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	})
+	mux.HandleFunc("/otheragent", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "otherbot: noindex")
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	})
+	mux.HandleFunc("/meta", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `<html><head><meta name="robots" content="NoIndex, follow"><title>My title</title></head></html>`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		path   string
+		status string
+		title  string
+	}{
+		{"/page", linkOK, "My title"},
+		{"/private", linkDisallowed, ""},
+		{"/nopreview/page", linkDisallowed, ""},
+		{"/header", linkDisallowed, ""},
+		{"/otheragent", linkOK, "My title"},
+		{"/meta", linkDisallowed, ""},
+	}
+
+	defer func(respect bool) { respectRobots = respect }(respectRobots)
+	for _, respectRobots = range []bool{false, true} {
+		for _, test := range tests {
+			status, title := test.status, test.title
+			if !respectRobots {
+				status, title = linkOK, "My title"
+			}
+			for r := range processLinks([]string{ts.URL + test.path}) {
+				if r.status != status || r.title != title {
+					t.Errorf("%q(%q) => %q %q, expect %q %q", getFunctionName(processLinks), test.path, r.status, r.title, status, title)
+				}
+			}
+		}
+	}
+
+	// failed fetch is retried once robotsRetryTTL is over
+	var mutex sync.Mutex
+	down := true
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if down {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		fmt.Fprintln(w, "User-agent: *\nDisallow: /")
+	}))
+	defer flaky.Close()
+	defer func(ttl time.Duration) { robotsRetryTTL = ttl }(robotsRetryTTL)
+	robotsRetryTTL = 50 * time.Millisecond
+	if !robots.allowed(context.Background(), flaky.URL+"/page") {
+		t.Errorf("%q(%q) => disallowed, expect unreachable robots.txt to allow everything", getFunctionName(robots.allowed), flaky.URL)
+	}
+	mutex.Lock()
+	down = false
+	mutex.Unlock()
+	time.Sleep(2 * robotsRetryTTL)
+	if robots.allowed(context.Background(), flaky.URL+"/page") {
+		t.Errorf("%q(%q) => allowed, expect robots.txt to be fetched again", getFunctionName(robots.allowed), flaky.URL)
+	}
+
+	// robots.txt is fetched as links are, so server errors trip the breaker
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	defer func(failures int) { breakerFailures = failures }(breakerFailures)
+	breakerFailures = 1
+	if robots.allowed(context.Background(), failing.URL+"/page") {
+		t.Errorf("%q(%q) => allowed, expect server error to disallow everything", getFunctionName(robots.allowed), failing.URL)
+	}
+	if state := breakers.expStates.Get(hostOf(failing.URL)); state == nil || state.String() != `"open"` {
+		t.Errorf("%q(%q) => breaker is %v, expect %q", getFunctionName(robots.allowed), failing.URL, state, breakerOpen)
+	}
+
+	// cache is bounded
+	ready := make(chan struct{})
+	close(ready)
+	robots.mutex.Lock()
+	saved := robots.hosts
+	robots.hosts = make(map[string]*robotsEntry)
+	for i := 0; i < maxRobotsEntries; i++ {
+		robots.hosts[fmt.Sprintf("http://host%d.example.com", i)] = &robotsEntry{ready: ready, expires: time.Now().Add(time.Hour)}
+	}
+	robots.mutex.Unlock()
+	robots.allowed(context.Background(), ts.URL+"/page")
+	robots.mutex.Lock()
+	cached := len(robots.hosts)
+	robots.hosts = saved
+	robots.mutex.Unlock()
+	if cached > maxRobotsEntries {
+		t.Errorf("%q() => %d policies cached, expect at most %d", getFunctionName(robots.allowed), cached, maxRobotsEntries)
+	}
+}
+
+// fakeFTPServer is an in-process FTP stand-in server, it knows just enough
+// commands to serve a single file and a single directory
+type fakeFTPServer struct {
+	ln       net.Listener
+	user     string // expected user ("anonymous" if any user is fine)
+	password string
+	mutex    sync.Mutex
+	requests string // "requests" expvar at the time of the last login
+}
+
+func newFakeFTPServer(t *testing.T, user, password string) *fakeFTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeFTPServer{ln: ln, user: user, password: password}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeFTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 fake FTP ready")
+	var user, dir string
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg := line, ""
+		if i := strings.Index(line, " "); i > 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		switch cmd {
+		case "USER":
+			user = arg
+			c.PrintfLine("331 password please")
+		case "PASS":
+			if user != s.user || arg != s.password {
+				c.PrintfLine("530 login incorrect")
+			} else {
+				s.mutex.Lock()
+				s.requests = global.expRequests.String()
+				s.mutex.Unlock()
+				c.PrintfLine("230 logged in")
+			}
+		case "TYPE":
+			c.PrintfLine("200 ok")
+		case "SIZE":
+			if arg == "/pub/file.txt" {
+				c.PrintfLine("213 1234")
+			} else {
+				c.PrintfLine("550 not a file")
+			}
+		case "MDTM":
+			c.PrintfLine("213 20160506070809")
+		case "CWD":
+			if arg == "/pub" || arg == "/pub/" {
+				dir = arg
+				c.PrintfLine("250 ok")
+			} else {
+				c.PrintfLine("550 no such directory")
+			}
+		case "PASV":
+			data, _ := net.Listen("tcp", "127.0.0.1:0")
+			port := data.Addr().(*net.TCPAddr).Port
+			c.PrintfLine("227 Entering Passive Mode (127,0,0,1,%d,%d)", port>>8, port&0xff)
+			line, _ := c.ReadLine()
+			if line != "NLST" || dir == "" {
+				c.PrintfLine("500 unexpected %s", line)
+				data.Close()
+				continue
+			}
+			c.PrintfLine("150 here it comes")
+			if dc, err := data.Accept(); err == nil {
+				fmt.Fprint(dc, "file.txt\r\nother.txt\r\n")
+				dc.Close()
+			}
+			data.Close()
+			c.PrintfLine("226 done")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestFTPLinks(t *testing.T) {
+	anonymous := newFakeFTPServer(t, "anonymous", "anonymous@")
+	defer anonymous.ln.Close()
+	private := newFakeFTPServer(t, "user", "secret")
+	defer private.ln.Close()
+
+	base := "ftp://" + anonymous.ln.Addr().String()
+	tests := []struct {
+		url    string
+		status string
+		title  string
+	}{
+		{base + "/pub/file.txt", linkOK, "file.txt (1234 bytes, modified 2016-05-06 07:08:09 UTC)"},
+		{base + "/pub/", linkOK, "pub/ (directory, 2 entries)"},
+		{base + "/pub", linkOK, "pub/ (directory, 2 entries)"},
+		{base + "/missing", linkFTPError, ""},
+		{"ftp://user:secret@" + private.ln.Addr().String() + "/pub/file.txt", linkOK, "file.txt (1234 bytes, modified 2016-05-06 07:08:09 UTC)"},
+		{"ftp://user:wrong@" + private.ln.Addr().String() + "/pub/file.txt", linkFTPError, ""},
+		{"ftp://" + private.ln.Addr().String() + "/pub/file.txt", linkFTPError, ""},
+		// no command injection via path or credentials
+		{base + "/pub/file.txt%0D%0ADELE%20file.txt", linkInvalidURL, ""},
+		{"ftp://user%0D%0APASS%20x:secret@" + private.ln.Addr().String() + "/pub/", linkInvalidURL, ""},
+		{base + "/pub/%00", linkInvalidURL, ""},
+	}
+	for _, test := range tests {
+		for r := range processLinks([]string{test.url}) {
+			if r.status != test.status || r.title != test.title {
+				t.Errorf("%q(%q) => %q %q %q, expect %q %q", getFunctionName(processLinks), test.url, r.status, r.title, r.message, test.status, test.title)
+			}
+		}
+	}
+
+	// password is not published with requests in progress
+	private.mutex.Lock()
+	requests := private.requests
+	private.mutex.Unlock()
+	if !strings.Contains(requests, private.ln.Addr().String()) || strings.Contains(requests, "secret") {
+		t.Errorf("%q() => requests in progress %s, expect ftp url with masked password", getFunctionName(global.addURL), requests)
+	}
+
+	// structured info is reported as well
+	for r := range processLinks([]string{base + "/pub/"}) {
+		info := newURLResponse(r).FTP
+		if info == nil || !info.IsDir || fmt.Sprint(info.Entries) != "[file.txt other.txt]" {
+			t.Errorf("%q(%q) => %+v, expect directory with 2 entries", getFunctionName(newURLResponse), base+"/pub/", info)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name+pathParam(r, "id"))
+		}
+	}
+	rt := newRouter([]restHandler{
+		{Path: "/items", Method: "GET", Handler: handler("list")},
+		{Path: "/items", Method: "POST", Handler: handler("create")},
+		{Path: "/items/{id}", Method: "GET", Handler: handler("item")},
+		{Path: "/items/new", Method: "GET", Handler: handler("new")},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		body   string
+		allow  string
+	}{
+		{"GET", "/items", http.StatusOK, "list", ""},
+		{"POST", "/items/", http.StatusOK, "create", ""},
+		{"GET", "/items/42", http.StatusOK, "item42", ""},
+		{"GET", "/items/new", http.StatusOK, "new", ""},
+		{"HEAD", "/items/42", http.StatusOK, "", ""},
+		{"DELETE", "/items", http.StatusMethodNotAllowed, "method_not_allowed", "GET, HEAD, OPTIONS, POST"},
+		{"POST", "/items/42", http.StatusMethodNotAllowed, "method_not_allowed", "GET, HEAD, OPTIONS"},
+		{"OPTIONS", "/items", http.StatusNoContent, "", "GET, HEAD, OPTIONS, POST"},
+		{"GET", "/items/42/more", http.StatusNotFound, "404 page not found\n", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		body := w.Body.String()
+		if w.Code == http.StatusMethodNotAllowed {
+			var e ErrorResponse
+			json.Unmarshal(w.Body.Bytes(), &e)
+			body = e.Error.Code
+		}
+		if w.Code != test.code || body != test.body || w.Header().Get("Allow") != test.allow {
+			t.Errorf("%s %s => %d %q %q, expect %d %q %q", test.method, test.path,
+				w.Code, w.Body.String(), w.Header().Get("Allow"), test.code, test.body, test.allow)
+		}
+	}
+
+	// declared methods are enforced for the service handlers as well
+	w := httptest.NewRecorder()
+	apiRouter.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/parse", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "OPTIONS, POST" {
+		t.Errorf("GET /api/v1/parse => %d %q, expect %d %q", w.Code, w.Header().Get("Allow"), http.StatusMethodNotAllowed, "OPTIONS, POST")
+	}
+	w = httptest.NewRecorder()
+	apiRouter.ServeHTTP(w, httptest.NewRequest("GET", "/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /unknown => %d, expect %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestParsingHandlerErrors(t *testing.T) {
+	tests := []struct {
+		contentType string
+		query       string
+		body        string
+		code        int
+		errorCode   string
+	}{
+		{"application/json", "", `{"message":"@test"}`, http.StatusOK, ""},
+		{"", "", `{"message":"@test"}`, http.StatusOK, ""},
+		{"text/plain", "", `{"message":"@test"}`, http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{"application/json", "", `{"message":`, http.StatusBadRequest, "malformed_json"},
+		{"application/json", "", `{"message":}`, http.StatusBadRequest, "malformed_json"},
+		{"application/json", "", `{"message":1}`, http.StatusUnprocessableEntity, "invalid_field"},
+		{"application/json", "", `{"message":"x", "extra":1}`, http.StatusOK, ""},
+		{"application/json", "?strict=true", `{"message":"x", "extra":1}`, http.StatusUnprocessableEntity, "unknown_field"},
+		{"application/json", "?strict=true", `{"message":"x"} {}`, http.StatusBadRequest, "trailing_data"},
+		{"application/json", "", `{"message":"x"} garbage`, http.StatusBadRequest, "trailing_data"},
+		{"application/json", "", `{"message":"x"} {}`, http.StatusBadRequest, "trailing_data"},
+		{"application/json", "", `{"message":"` + strings.Repeat("x", maxRequestSize) + `"}`, http.StatusRequestEntityTooLarge, "payload_too_large"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/api/v1/parse"+test.query, strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, r)
+		var e ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &e)
+		if w.Code != test.code || e.Error.Code != test.errorCode || (test.errorCode != "" && e.Error.RequestID == "") {
+			t.Errorf("POST %q => %d %+v, expect %d %q", test.body[:10], w.Code, e.Error, test.code, test.errorCode)
+		}
+	}
+}
+
+func TestBatchParsingHandler(t *testing.T) {
+	var mutex sync.Mutex
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		calls++
+		mutex.Unlock()
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+
+	request := `{"messages": [
+		{"id": "a", "message": "@test ` + ts.URL + `"},
+		{"id": "", "message": "(smile)"},
+		{"id": "c", "message": "(smile) ` + ts.URL + ` ` + ts.URL + `/2"},
+		{"id": "a", "message": "@dup"}
+	]}`
+	w := httptest.NewRecorder()
+	apiRouter.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/parse/batch", strings.NewReader(request)))
+	var response BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("POST /api/v1/parse/batch => %d %s", w.Code, w.Body.String())
+	}
+	if len(response.Results) != 4 {
+		t.Fatalf("POST /api/v1/parse/batch => %d results, expect %d", len(response.Results), 4)
+	}
+	a, missing, c, dup := response.Results[0], response.Results[1], response.Results[2], response.Results[3]
+	if a.ID != "a" || a.Result == nil || fmt.Sprint(a.Result.Mentions) != "[test]" || a.Result.Links[0].Title != "My title" {
+		t.Errorf("result #0 => %+v, expect mention and link", a)
+	}
+	if missing.Error == nil || missing.Error.Code != "missing_id" || dup.Error == nil || dup.Error.Code != "duplicate_id" {
+		t.Errorf("results #1, #3 => %+v %+v, expect missing_id and duplicate_id errors", missing.Error, dup.Error)
+	}
+	if c.Result == nil || len(c.Result.Links) != 2 || c.Result.Links[0].URL != ts.URL || c.Result.Links[1].URL != ts.URL+"/2" {
+		t.Errorf("result #2 => %+v, expect 2 links in order", c.Result)
+	}
+	if calls != 2 {
+		t.Errorf("POST /api/v1/parse/batch => %d fetches, expect %d", calls, 2)
+	}
+
+	defer func(size int) { maxBatchSize = size }(maxBatchSize)
+	maxBatchSize = 1
+	w = httptest.NewRecorder()
+	apiRouter.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/parse/batch", strings.NewReader(request)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST /api/v1/parse/batch => %d, expect %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestStreamFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		format string
+	}{
+		{"", ""},
+		{"application/json", ""},
+		{streamNDJSON, streamNDJSON},
+		{"application/ndjson", streamNDJSON},
+		{"text/html;q=0.5, " + streamSSE, streamSSE},
+		{streamNDJSON + ";q=0", ""},
+		{streamNDJSON + ";q=0.0", ""},
+		{streamNDJSON + ";q=0.000", ""},
+		{"application/json, " + streamNDJSON + ";q=0.1", ""},
+		{"application/json;q=0.5, " + streamNDJSON, streamNDJSON},
+		{"*/*;q=0.8, " + streamSSE + ";q=0.9", streamSSE},
+		{"application/*, " + streamSSE + ";q=0.9", ""},
+		{streamSSE + ";q=0.5, " + streamNDJSON + ";q=0.7", streamNDJSON},
+		{"application/json, " + streamNDJSON, ""},
+		{streamNDJSON + ";q=bad", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/api/v1/parse", nil)
+		r.Header.Set("Accept", test.accept)
+		if format := streamFormat(r); format != test.format {
+			t.Errorf("%s(Accept: %s) => %q, expect %q", getFunctionName(streamFormat), test.accept, format, test.format)
+		}
+	}
+}
+
+func TestStreamParsing(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+	service := httptest.NewServer(apiRouter)
+	defer service.Close()
+
+	for _, accept := range []string{streamNDJSON, "text/html;q=0.5, " + streamSSE} {
+		request := `{"message": "@test ` + ts.URL + `/slow ` + ts.URL + `/fast ` + ts.URL + `/slow"}`
+		req, _ := http.NewRequest("POST", service.URL+"/api/v1/parse", strings.NewReader(request))
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), streamFormat(req)) {
+			t.Errorf("Accept: %s => Content-Type: %s", accept, resp.Header.Get("Content-Type"))
+		}
+		events := bufio.NewReader(resp.Body)
+		next := func() string {
+			for {
+				line, err := events.ReadString('\n')
+				if err != nil {
+					return ""
+				}
+				line = strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+				if line != "" && !strings.HasPrefix(line, "event: ") {
+					return line
+				}
+			}
+		}
+
+		var entities EntitiesEvent
+		json.Unmarshal([]byte(next()), &entities)
+		if entities.Type != eventEntities || len(entities.Links) != 3 || entities.Links[0].Status != linkPending || entities.Mentions[0] != "test" {
+			t.Errorf("Accept: %s => first event %+v, expect entities with 3 pending links", accept, entities)
+		}
+		// fast link is delivered while the slow one is still in progress
+		var link LinkEvent
+		json.Unmarshal([]byte(next()), &link)
+		if link.Type != eventLink || link.Link.URL != ts.URL+"/fast" || link.Link.Title != "My title" {
+			t.Errorf("Accept: %s => second event %+v, expect fast link", accept, link)
+		}
+		release <- struct{}{}
+		json.Unmarshal([]byte(next()), &link)
+		if link.Type != eventLink || link.Link.URL != ts.URL+"/slow" {
+			t.Errorf("Accept: %s => third event %+v, expect slow link", accept, link)
+		}
+		var done DoneEvent
+		json.Unmarshal([]byte(next()), &done)
+		if done.Type != eventDone {
+			t.Errorf("Accept: %s => last event %+v, expect done", accept, done)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	var mutex sync.Mutex
+	fetches := 0
+	started, canceled := make(chan struct{}, 1), make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		fetches++
+		mutex.Unlock()
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-r.Context().Done()
+			canceled <- struct{}{}
+			return
+		}
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+	service := httptest.NewServer(apiRouter)
+	defer service.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(service.URL, "http")+"/api/v1/ws", "", service.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	receive := func() map[string]interface{} {
+		var event map[string]interface{}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.JSON.Receive(ws, &event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	websocket.JSON.Send(ws, WSDraft{1, "hey " + ts.URL + "/slow"})
+	if event := receive(); event["type"] != eventEntities || event["seq"] != 1.0 {
+		t.Errorf("draft #1 => %v, expect entities", event)
+	}
+	// the slow fetch should reach the server, a canceled fetch
+	// still waiting for a slot is given up without a request
+	<-started
+
+	// the next draft cancels the slow fetch of the previous one
+	websocket.JSON.Send(ws, WSDraft{2, "hey @test " + ts.URL + "/fast"})
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("draft #2 => fetch of draft #1 is not canceled")
+	}
+	for _, expect := range []string{eventEntities, eventLink, eventDone} {
+		if event := receive(); event["type"] != expect || event["seq"] != 2.0 {
+			t.Errorf("draft #2 => %v, expect %s", event, expect)
+		}
+	}
+
+	// already fetched link is reported right away
+	websocket.JSON.Send(ws, WSDraft{3, "hey @test " + ts.URL + "/fast!"})
+	websocket.JSON.Send(ws, WSDraft{4, "hey " + ts.URL + "/fast"})
+	event := receive()
+	for event["seq"] != 4.0 {
+		event = receive()
+	}
+	links, _ := event["links"].([]interface{})
+	if event["type"] != eventEntities || len(links) != 1 || links[0].(map[string]interface{})["status"] != linkOK {
+		t.Errorf("draft #4 => %v, expect entities with cached link", event)
+	}
+	if event := receive(); event["type"] != eventDone {
+		t.Errorf("draft #4 => %v, expect done", event)
+	}
+
+	// invalid and oversized drafts are reported, the connection stays open
+	websocket.Message.Send(ws, `{"seq":"5"}`)
+	websocket.Message.Send(ws, `{"seq":6,"msg":"`+strings.Repeat("x", maxRequestSize)+`"}`)
+	for _, expect := range []string{"invalid_field", "payload_too_large"} {
+		event := receive()
+		if e, _ := event["error"].(map[string]interface{}); event["type"] != eventError || e["code"] != expect {
+			t.Errorf("invalid draft => %v, expect %s error", event, expect)
+		}
+	}
+	websocket.JSON.Send(ws, WSDraft{7, "hey @test"})
+	if event := receive(); event["type"] != eventEntities || event["seq"] != 7.0 {
+		t.Errorf("draft #7 => %v, expect entities", event)
+	}
+
+	// foreign pages may connect only if their origin is allowed by CORS
+	defer func(policy *corsPolicy) { cors = policy }(cors)
+	cors, _ = newCORSPolicy(corsSettings{origins: "https://app.example.com"})
+	for origin, allowed := range map[string]bool{"https://evil.example.com": false, "https://app.example.com": true} {
+		conn, err := websocket.Dial("ws"+strings.TrimPrefix(service.URL, "http")+"/api/v1/ws", "", origin)
+		if (err == nil) != allowed {
+			t.Errorf("Origin: %s => %v, expect allowed %v", origin, err, allowed)
+		}
+		if err == nil {
+			conn.Close()
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if fetches > 3 {
+		t.Errorf("drafts #1-#4 => %d fetches, expect at most %d", fetches, 3)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer(nil)
+	go server.Serve(listener)
+	defer server.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := parserpb.NewParserClient(conn)
+	ctx := context.Background()
+
+	response, err := client.Parse(ctx, &parserpb.ParseRequest{Message: "@test (smile) " + ts.URL})
+	if err != nil {
+		t.Fatalf("%s => %v", getFunctionName(client.Parse), err)
+	}
+	if len(response.Mentions) != 1 || len(response.Emoticons) != 1 || len(response.Links) != 1 ||
+		response.Links[0].Title != "My title" || response.Links[0].Status != linkOK || response.Links[0].StatusCode != 200 {
+		t.Errorf("%s => %v, expect mention, emoticon and titled link", getFunctionName(client.Parse), response)
+	}
+
+	batch, err := client.ParseBatch(ctx, &parserpb.ParseBatchRequest{Messages: []*parserpb.BatchMessage{
+		{Id: "1", Message: ts.URL},
+		{Id: "1", Message: "@dup"},
+	}})
+	if err != nil {
+		t.Fatalf("%s => %v", getFunctionName(client.ParseBatch), err)
+	}
+	if len(batch.Results) != 2 || batch.Results[0].GetResult().GetLinks()[0].GetTitle() != "My title" ||
+		batch.Results[1].GetError().GetCode() != "duplicate_id" {
+		t.Errorf("%s => %v, expect result and duplicate_id error", getFunctionName(client.ParseBatch), batch)
+	}
+	_, err = client.ParseBatch(ctx, &parserpb.ParseBatchRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("%s(empty batch) => %v, expect %s", getFunctionName(client.ParseBatch), err, codes.InvalidArgument)
+	}
+
+	stream, err := client.StreamParse(ctx, &parserpb.ParseRequest{Message: ts.URL + "/a " + ts.URL + "/b"})
+	if err != nil {
+		t.Fatalf("%s => %v", getFunctionName(client.StreamParse), err)
+	}
+	var events []*parserpb.ParseEvent
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			break
+		}
+		events = append(events, event)
+	}
+	if len(events) != 4 || len(events[0].GetEntities().GetLinks()) != 2 || events[0].GetEntities().GetLinks()[0].GetStatus() != linkPending ||
+		events[1].GetLink().GetTitle() != "My title" || events[2].GetLink().GetTitle() != "My title" || events[3].GetDone() == nil {
+		t.Errorf("%s => %v, expect entities, 2 links and done", getFunctionName(client.StreamParse), events)
+	}
+
+	// request id is taken from metadata (or generated) and returned in header
+	for _, id := range []string{"grpc-call-1", ""} {
+		var header metadata.MD
+		callCtx := ctx
+		if id != "" {
+			callCtx = metadata.AppendToOutgoingContext(ctx, "x-request-id", id)
+		}
+		if _, err := client.Parse(callCtx, &parserpb.ParseRequest{Message: "@test"}, grpc.Header(&header)); err != nil {
+			t.Fatalf("%s => %v", getFunctionName(client.Parse), err)
+		}
+		if got := header.Get("x-request-id"); len(got) != 1 || (id != "" && got[0] != id) || got[0] == "" {
+			t.Errorf("%s(x-request-id %q) => header %v, expect the id returned", getFunctionName(client.Parse), id, got)
+		}
+	}
+
+	// calls are shed as REST requests are
+	defer func(wait time.Duration) { shedQueueWait = wait }(shedQueueWait)
+	shedQueueWait = time.Second
+	global.mutex.Lock()
+	global.waiters[-1] = time.Now().Add(-time.Minute)
+	global.mutex.Unlock()
+	_, err = client.Parse(ctx, &parserpb.ParseRequest{Message: "@test"})
+	global.mutex.Lock()
+	delete(global.waiters, -1)
+	global.mutex.Unlock()
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("%s while fetch queue is slow => %v, expect %s", getFunctionName(client.Parse), err, codes.Unavailable)
+	}
+}
+
+func TestParsingJobs(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+	service := httptest.NewServer(apiRouter)
+	defer service.Close()
+
+	getJob := func(location string) (int, JobResponse) {
+		var job JobResponse
+		resp, err := http.Get(service.URL + location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&job)
+		return resp.StatusCode, job
+	}
+
+	// polling
+	resp, err := http.Post(service.URL+"/api/v1/parse?async=true", "application/json",
+		strings.NewReader(`{"message": "@test `+ts.URL+`/slow `+ts.URL+`/fast"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusAccepted || !strings.HasPrefix(location, "/api/v1/jobs/") {
+		t.Fatalf("async parse => %d, Location: %s, expect %d and job location", resp.StatusCode, location, http.StatusAccepted)
+	}
+	var job JobResponse
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, job = getJob(location); job.LinksDone == 1 {
+			break
+		}
+	}
+	if job.Status != jobRunning || job.LinksTotal != 2 || job.Result == nil || job.Result.Links[0].Status != linkPending || job.Result.Links[1].Title != "My title" {
+		t.Errorf("%s => %+v, expect running job with fast link done", location, job)
+	}
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && job.Status != jobDone; time.Sleep(10 * time.Millisecond) {
+		_, job = getJob(location)
+	}
+	if job.Status != jobDone || job.LinksDone != 2 || job.Result.Links[0].Title != "My title" || job.ExpiresAt == nil {
+		t.Errorf("%s => %+v, expect done job", location, job)
+	}
+	jobs.expire(job.ExpiresAt.Add(time.Second))
+	if code, _ := getJob(location); code != http.StatusNotFound {
+		t.Errorf("%s after expiration => %d, expect %d", location, code, http.StatusNotFound)
+	}
+
+	// webhook is signed and retried
+	defer func(secret string, delay, maxDelay time.Duration, client *http.Client) {
+		webhookSecret, retryBaseDelay, retryMaxDelay, webhookClient, webhookAllowHosts = secret, delay, maxDelay, client, ""
+	}(webhookSecret, retryBaseDelay, retryMaxDelay, webhookClient)
+	retryBaseDelay, retryMaxDelay = time.Millisecond, time.Millisecond
+	request := `{"message": "` + ts.URL + `/fast", "callback_url": "%s"}`
+	for _, test := range []struct{ secret, callback, code string }{
+		{"", "http://localhost/", "callbacks_disabled"},
+		{"secret", "ftp://localhost/", "invalid_field"},
+		{"secret", "http://localhost:8080/", "invalid_field"},
+		{"secret", "http://169.254.169.254/latest/", "invalid_field"},
+		{"secret", "http://[::1]/", "invalid_field"},
+		{"secret", "http://10.1.2.3/", "invalid_field"},
+	} {
+		webhookSecret = test.secret
+		resp, _ := http.Post(service.URL+"/api/v1/parse", "application/json", strings.NewReader(fmt.Sprintf(request, test.callback)))
+		var e ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&e)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnprocessableEntity || e.Error.Code != test.code {
+			t.Errorf("callback %q => %d %s, expect %d %s", test.callback, resp.StatusCode, e.Error.Code, http.StatusUnprocessableEntity, test.code)
+		}
+	}
+
+	delivered := make(chan JobResponse, 1)
+	attempts := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if attempts++; attempts == 1 {
+			// Retry-After is capped by retryMaxDelay
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get(headerSignature) != signWebhook("secret", r.Header.Get(headerTimestamp), body) {
+			t.Errorf("webhook => invalid signature %s", r.Header.Get(headerSignature))
+		}
+		var job JobResponse
+		json.Unmarshal(body, &job)
+		delivered <- job
+	}))
+	defer hook.Close()
+
+	// internal addresses are not connected to unless allowed
+	webhookClient, err = newWebhookClient(fetchConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webhookClient.Get(hook.URL); !errors.Is(err, errInternalCallback) {
+		t.Errorf("%q() => %v, expect %v", getFunctionName(newWebhookClient), err, errInternalCallback)
+	}
+	webhookAllowHosts = "127.0.0.1"
+
+	resp, _ = http.Post(service.URL+"/api/v1/parse", "application/json", strings.NewReader(fmt.Sprintf(request, hook.URL)))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("parse with callback => %d, expect %d", resp.StatusCode, http.StatusAccepted)
+	}
+	select {
+	case job = <-delivered:
+		if job.Status != jobDone || job.Result.Links[0].Title != "My title" {
+			t.Errorf("webhook => %+v, expect done job", job)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook => not delivered")
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, job = getJob(resp.Header.Get("Location")); job.Callback != nil && job.Callback.Status != callbackPending {
+			break
+		}
+	}
+	if job.Callback == nil || job.Callback.Status != callbackDelivered || job.Callback.Attempts != 2 {
+		t.Errorf("job with callback => %+v, expect delivered in 2 attempts", job.Callback)
+	}
+}
+
+func TestParsingOptions(t *testing.T) {
+	var mutex sync.Mutex
+	languages := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		languages = append(languages, r.Header.Get("Accept-Language"))
+		mutex.Unlock()
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+
+	parse := func(options string) (int, map[string]interface{}) {
+		body := `{"message": "@test (smile) ` + ts.URL + `/a ` + ts.URL + `/b ` + ts.URL + `/a", "options": ` + options + `}`
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/parse", strings.NewReader(body)))
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+	linkStatuses := func(response map[string]interface{}) []string {
+		statuses := []string{}
+		links, _ := response["links"].([]interface{})
+		for _, l := range links {
+			statuses = append(statuses, fmt.Sprint(l.(map[string]interface{})["status"]))
+		}
+		return statuses
+	}
+
+	for _, options := range []string{
+		`{"entities": ["hashtags"]}`,
+		`{"max_links": -1}`,
+		`{"timeout_ms": -1}`,
+		`{"language": "en\r\nX-Evil: 1"}`,
+		`{"fields": ["body"]}`,
+	} {
+		code, response := parse(options)
+		e, _ := response["error"].(map[string]interface{})
+		if code != http.StatusUnprocessableEntity || e["code"] != "invalid_option" {
+			t.Errorf("options %s => %d %v, expect %d invalid_option", options, code, response, http.StatusUnprocessableEntity)
+		}
+	}
+
+	tests := []struct {
+		options  string
+		statuses string
+	}{
+		{`null`, "[ok ok ok]"},
+		{`{"entities": ["mentions"]}`, "[]"},
+		{`{"fetch_links": false}`, "[skipped skipped skipped]"},
+		{`{"max_links": 1}`, "[ok skipped ok]"},
+		{`{"language": "de, en;q=0.5"}`, "[ok ok ok]"},
+	}
+	for _, test := range tests {
+		mutex.Lock()
+		languages = languages[:0]
+		mutex.Unlock()
+		code, response := parse(test.options)
+		if statuses := fmt.Sprint(linkStatuses(response)); code != http.StatusOK || statuses != test.statuses {
+			t.Errorf("options %s => %d %s, expect %d %s", test.options, code, statuses, http.StatusOK, test.statuses)
+		}
+		mutex.Lock()
+		if strings.Contains(test.options, "language") && (len(languages) == 0 || languages[0] != "de, en;q=0.5") {
+			t.Errorf("options %s => Accept-Language %v, expect de, en;q=0.5", test.options, languages)
+		}
+		mutex.Unlock()
+	}
+	if _, response := parse(`{"entities": ["mentions"]}`); len(response["emoticons"].([]interface{})) != 0 || len(response["mentions"].([]interface{})) != 1 {
+		t.Errorf("options {\"entities\": [\"mentions\"]} => %v, expect mentions only", response)
+	}
+
+	// fields are selected and timeout is capped per request
+	body := `{"message": "` + ts.URL + `/slow", "options": {"fields": ["status"], "timeout_ms": 100}}`
+	w := httptest.NewRecorder()
+	apiRouter.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/parse", strings.NewReader(body)))
+	var response struct{ Links []map[string]interface{} }
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if len(response.Links) != 1 || len(response.Links[0]) != 2 || response.Links[0]["status"] != linkTimeout || response.Links[0]["url"] != ts.URL+"/slow" {
+		t.Errorf("fields and timeout options => %v, expect url and timeout status only", response.Links)
+	}
+
+	// selected fields keep the struct order
+	link := URLResponse{URL: "http://a.com/<b>", Title: "A", Status: linkOK, Attempts: 1, fields: []string{"attempts", "message", "status", "title"}}
+	expect := `{"url":"http://a.com/\u003cb\u003e","title":"A","status":"ok","attempts":1}`
+	if data, err := json.Marshal(link); err != nil || string(data) != expect {
+		t.Errorf("%q() => %s %v, expect %s", getFunctionName(link.MarshalJSON), data, err, expect)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+
+	hash := func(secret string) string {
+		h := sha256.Sum256([]byte(secret))
+		return hex.EncodeToString(h[:])
+	}
+	keys := `[
+		{"name": "parser", "secret_sha256": "` + hash("parser-key") + `", "scopes": ["parse"], "requests_per_minute": 2, "fetches_per_minute": 2},
+		{"name": "admin", "secret_sha256": "` + hash("admin-key") + `", "scopes": ["admin"]},
+		{"name": "alice", "secret_sha256": "` + hash("alice-key") + `", "scopes": ["parse"]},
+		{"name": "bob", "secret_sha256": "` + hash("bob-key") + `", "scopes": ["parse"]}
+	]`
+	file, err := ioutil.TempFile("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(keys)
+	file.Close()
+	if err := apiKeys.load(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		apiKeys.mutex.Lock()
+		apiKeys.keys = nil
+		apiKeys.mutex.Unlock()
+	}()
+
+	tests := []struct {
+		method, path, key, body string
+		code                    int
+		errorCode               string
+	}{
+		{"GET", "/", "", "", http.StatusOK, ""},
+		{"POST", "/api/v1/parse", "", `{"message": "@test"}`, http.StatusUnauthorized, "unauthorized"},
+		{"POST", "/api/v1/parse", "Bearer wrong-key", `{"message": "@test"}`, http.StatusUnauthorized, "unauthorized"},
+		{"GET", "/selftest", "Bearer parser-key", "", http.StatusForbidden, "forbidden"},
+		{"POST", "/api/v1/parse", "Bearer parser-key", `{"message": "` + ts.URL + `/a ` + ts.URL + `/b ` + ts.URL + `/a"}`, http.StatusOK, ""},
+		{"POST", "/api/v1/parse", "Bearer parser-key", `{"message": "` + ts.URL + `/c"}`, http.StatusTooManyRequests, "quota_exceeded"},
+		{"POST", "/api/v1/parse", "Bearer parser-key", `{"message": "@test"}`, http.StatusTooManyRequests, "quota_exceeded"},
+		{"GET", "/debug/vars", "Bearer admin-key", "", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.key != "" {
+			r.Header.Set("Authorization", test.key)
+		}
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, r)
+		var e ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &e)
+		if w.Code != test.code || e.Error.Code != test.errorCode {
+			t.Errorf("%s %s (%s) => %d %q, expect %d %q", test.method, test.path, test.key, w.Code, e.Error.Code, test.code, test.errorCode)
+		}
+		switch {
+		case w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "":
+			t.Errorf("%s %s (%s) => no WWW-Authenticate header", test.method, test.path, test.key)
+		case w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "":
+			t.Errorf("%s %s (%s) => no Retry-After header", test.method, test.path, test.key)
+		case test.path == "/debug/vars" && !strings.Contains(w.Body.String(), `"parser": {"fetches": 2, "forbidden": 1, "requests": 2, "throttled": 2}`):
+			t.Errorf("%s %s => no usage of parser key in %s", test.method, test.path, w.Body.String())
+		}
+	}
+
+	// jobs are visible to the key they are created with only
+	r := httptest.NewRequest("POST", "/api/v1/parse?async=true", strings.NewReader(`{"message": "@test"}`))
+	r.Header.Set("X-API-Key", "alice-key")
+	w := httptest.NewRecorder()
+	apiRouter.ServeHTTP(w, r)
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("async parse (alice-key) => %d, expect %d", w.Code, http.StatusAccepted)
+	}
+	for key, code := range map[string]int{"alice-key": http.StatusOK, "bob-key": http.StatusNotFound} {
+		r := httptest.NewRequest("GET", location, nil)
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("GET %s (%s) => %d, expect %d", location, key, w.Code, code)
+		}
+	}
+
+	// browsers pass the key to websocket as a subprotocol
+	service := httptest.NewServer(apiRouter)
+	defer service.Close()
+	for protocols, allowed := range map[string]bool{
+		"":       false,
+		"parser": false,
+		"parser," + wsKeyProtocol + base64.RawURLEncoding.EncodeToString([]byte("alice-key")): true,
+		"parser," + wsKeyProtocol + base64.RawURLEncoding.EncodeToString([]byte("wrong-key")): false,
+	} {
+		config, _ := websocket.NewConfig("ws"+strings.TrimPrefix(service.URL, "http")+"/api/v1/ws", service.URL)
+		if protocols != "" {
+			config.Protocol = strings.Split(protocols, ",")
+		}
+		conn, err := websocket.DialConfig(config)
+		if (err == nil) != allowed {
+			t.Errorf("websocket (protocols %q) => %v, expect allowed %v", protocols, err, allowed)
+		}
+		if err == nil {
+			if fmt.Sprint(conn.Config().Protocol) != "["+wsProtocol+"]" {
+				t.Errorf("websocket (protocols %q) => protocol %q, expect %q", protocols, conn.Config().Protocol, wsProtocol)
+			}
+			conn.Close()
+		}
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "admin-key"))
+	if _, err := authorizeGRPC(ctx); err != nil {
+		t.Errorf("%s(admin-key) => %v, expect no error", getFunctionName(authorizeGRPC), err)
+	}
+	if _, err := authorizeGRPC(context.Background()); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("%s(no key) => %v, expect %s", getFunctionName(authorizeGRPC), err, codes.Unauthenticated)
+	}
+}
+
+func TestLoadLimits(t *testing.T) {
+	defer func(proxies ipNets) { trustedProxies = proxies }(trustedProxies)
+	trustedProxies = nil
+	trustedProxies.Set("10.0.0.0/8, 192.168.1.1")
+	ipTests := []struct {
+		remoteAddr, forwardedFor, ip string
+	}{
+		{"203.0.113.1:1234", "198.51.100.1", "203.0.113.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "198.51.100.1, 203.0.113.7, 192.168.1.1", "203.0.113.7"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "garbage, 10.1.1.1", "10.1.1.1"},
+	}
+	for _, test := range ipTests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		if ip := clientIP(r); ip != test.ip {
+			t.Errorf("%s(%s, X-Forwarded-For: %s) => %s, expect %s", getFunctionName(clientIP), test.remoteAddr, test.forwardedFor, ip, test.ip)
+		}
+	}
+
+	serve := func(method, body, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", nil)
+		if body != "" {
+			r = httptest.NewRequest(method, "/api/v1/parse", strings.NewReader(body))
+		}
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, r)
+		return w
+	}
+
+	// token bucket per client IP
+	defer func(limit float64, burst int) { rateLimit, rateBurst = limit, burst }(rateLimit, rateBurst)
+	rateLimit, rateBurst = 1, 2
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if w := serve("GET", "", "203.0.113.10:1234"); w.Code != expected || (expected == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1") {
+			t.Errorf("request #%d => %d (Retry-After: %s), expect %d", i+1, w.Code, w.Header().Get("Retry-After"), expected)
+		}
+	}
+	if w := serve("GET", "", "203.0.113.11:1234"); w.Code != http.StatusOK {
+		t.Errorf("request of another client => %d, expect %d", w.Code, http.StatusOK)
+	}
+	// buckets are bounded even if none of them is idle
+	limiter.mutex.Lock()
+	saved := limiter.buckets
+	limiter.buckets = make(map[string]*tokenBucket)
+	for i := 0; i < maxRateBuckets; i++ {
+		limiter.buckets[fmt.Sprintf("client%d", i)] = &tokenBucket{last: time.Now()}
+	}
+	limiter.mutex.Unlock()
+	limiter.allow("203.0.113.14")
+	limiter.mutex.Lock()
+	buckets := len(limiter.buckets)
+	limiter.buckets = saved
+	limiter.mutex.Unlock()
+	if buckets > maxRateBuckets {
+		t.Errorf("%q() => %d buckets, expect at most %d", getFunctionName(limiter.allow), buckets, maxRateBuckets)
+	}
+	rateLimit = 0
+
+	// cap on in-flight parsing requests
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+	defer func(max int, wait time.Duration) { maxInFlight, shedQueueWait = max, wait }(maxInFlight, shedQueueWait)
+	maxInFlight = 1
+	done := make(chan int)
+	go func() {
+		done <- serve("POST", `{"message": "`+ts.URL+`"}`, "203.0.113.12:1234").Code
+	}()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		limiter.mutex.Lock()
+		inFlight := limiter.inFlight
+		limiter.mutex.Unlock()
+		if inFlight == 1 {
+			break
+		}
+	}
+	if w := serve("POST", `{"message": "@test"}`, "203.0.113.12:1234"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("request over in-flight cap => %d, expect %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if w := serve("GET", "", "203.0.113.12:1234"); w.Code != http.StatusOK {
+		t.Errorf("light request over in-flight cap => %d, expect %d", w.Code, http.StatusOK)
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("request within in-flight cap => %d, expect %d", code, http.StatusOK)
+	}
+
+	// async job keeps the slot of its request till the job is done
+	finish := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-finish
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer slow.Close()
+	r := httptest.NewRequest("POST", "/api/v1/parse?async=true", strings.NewReader(`{"message": "`+slow.URL+`"}`))
+	r.RemoteAddr = "203.0.113.12:1234"
+	accepted := httptest.NewRecorder()
+	apiRouter.ServeHTTP(accepted, r)
+	if accepted.Code != http.StatusAccepted {
+		t.Fatalf("async request => %d, expect %d", accepted.Code, http.StatusAccepted)
+	}
+	if w := serve("POST", `{"message": "@test"}`, "203.0.113.12:1234"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("request while async job is running => %d, expect %d", w.Code, http.StatusServiceUnavailable)
+	}
+	// websocket sessions take a slot only for drafts fetching links
+	service := httptest.NewServer(apiRouter)
+	defer service.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(service.URL, "http")+"/api/v1/ws", "", service.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	websocket.JSON.Send(ws, WSDraft{1, "hey " + slow.URL})
+	var event map[string]interface{}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Receive(ws, &event); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := event["error"].(map[string]interface{}); event["type"] != eventError || e["code"] != "overloaded" {
+		t.Errorf("draft while async job is running => %v, expect overloaded error", event)
+	}
+	close(finish)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		limiter.mutex.Lock()
+		inFlight := limiter.inFlight
+		limiter.mutex.Unlock()
+		if inFlight == 0 {
+			break
+		}
+	}
+	if w := serve("POST", `{"message": "@test"}`, "203.0.113.12:1234"); w.Code != http.StatusOK {
+		t.Errorf("request once async job is done => %d, expect %d", w.Code, http.StatusOK)
+	}
+
+	// shedding while fetch queue is slow, shed requests are not charged
+	// to the key (it has quota of a single request)
+	hash := sha256.Sum256([]byte("key"))
+	file, err := ioutil.TempFile("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`[{"name": "key", "secret_sha256": "` + hex.EncodeToString(hash[:]) + `", "scopes": ["parse"], "requests_per_minute": 1}]`)
+	file.Close()
+	if err := apiKeys.load(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		apiKeys.mutex.Lock()
+		apiKeys.keys = nil
+		apiKeys.mutex.Unlock()
+	}()
+	serveWithKey := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v1/parse", strings.NewReader(`{"message": "@test"}`))
+		r.RemoteAddr = "203.0.113.13:1234"
+		r.Header.Set("X-API-Key", "key")
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, r)
+		return w
+	}
+
+	maxInFlight, shedQueueWait = 0, time.Second
+	global.mutex.Lock()
+	global.waiters[-1] = time.Now().Add(-time.Minute)
+	global.mutex.Unlock()
+	w := serveWithKey()
+	global.mutex.Lock()
+	delete(global.waiters, -1)
+	global.mutex.Unlock()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("request while fetch queue is slow => %d (Retry-After: %s), expect %d", w.Code, w.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+	if w := serveWithKey(); w.Code != http.StatusOK {
+		t.Errorf("request once fetch queue is fast => %d, expect %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	slowStarted := make(chan struct{}, 1)
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			slowStarted <- struct{}{}
+			time.Sleep(300 * time.Millisecond)
+		case "/hang":
+			select {
+			case <-hang:
+			case <-r.Context().Done():
+			}
+		}
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+	defer close(hang)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: apiRouter}
+	go httpServer.Serve(l)
+	serviceURL := "http://" + l.Addr().String()
+	defer func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		service.mutex.Lock()
+		service.draining, service.ctx, service.cancel = false, ctx, cancel
+		service.mutex.Unlock()
+	}()
+
+	// async job fetches a link that never responds
+	resp, err := http.Post(serviceURL+"/api/v1/parse?async=true", "application/json", strings.NewReader(`{"message": "`+ts.URL+`/hang"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job JobResponse
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+
+	// sync request is in progress when draining starts
+	done := make(chan ServiceResponse)
+	go func() {
+		var result ServiceResponse
+		resp, err := http.Post(serviceURL+"/api/v1/parse", "application/json", strings.NewReader(`{"message": "`+ts.URL+`/slow"}`))
+		if err == nil {
+			json.NewDecoder(resp.Body).Decode(&result)
+			resp.Body.Close()
+		}
+		done <- result
+	}()
+	<-slowStarted
+
+	// websocket client is asked to go away
+	ws, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	fmt.Fprintf(ws, "GET /api/v1/ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", l.Addr())
+	wsReader := bufio.NewReader(ws)
+	if resp, err := http.ReadResponse(wsReader, nil); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("websocket handshake => %v %v, expect %d", resp, err, http.StatusSwitchingProtocols)
+	}
+
+	// service keeps serving, but is not ready during drain delay
+	start := time.Now()
+	drained := make(chan struct{})
+	go func() {
+		service.drain(httpServer, nil, 200*time.Millisecond, time.Second)
+		close(drained)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for path, code := range map[string]int{"/": http.StatusOK, "/readyz": http.StatusServiceUnavailable} {
+		if resp, err := http.Get(serviceURL + path); err != nil || resp.StatusCode != code {
+			t.Errorf("GET %s during drain delay => %v %v, expect %d", path, resp, err, code)
+		} else {
+			resp.Body.Close()
+		}
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame := make([]byte, 4)
+	if _, err := io.ReadFull(wsReader, frame); err != nil || fmt.Sprintf("%x", frame) != "880203e9" {
+		t.Errorf("websocket on drain => frame %x %v, expect close with going away status", frame, err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("websocket on drain => closed in %s, expect after drain delay", elapsed)
+	}
+
+	<-drained
+	if elapsed := time.Since(start); elapsed < 1200*time.Millisecond || elapsed > 3200*time.Millisecond {
+		t.Errorf("drain => took %s, expect about drain delay and timeout (%s)", elapsed, 1200*time.Millisecond)
+	}
+	if !service.isDraining() {
+		t.Errorf("%s => not draining after drain", getFunctionName(service.isDraining))
+	}
+	if result := <-done; len(result.Links) != 1 || result.Links[0].Status != linkOK {
+		t.Errorf("request in progress => %+v, expect completed", result)
+	}
+	if _, err := http.Get(serviceURL + "/"); err == nil {
+		t.Errorf("request after drain => no error, expect connection refused")
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && job.Status != jobDone; time.Sleep(10 * time.Millisecond) {
+		job = jobs.get(job.ID, "").snapshot()
+	}
+	if job.Status != jobDone || job.Result.Links[0].Status != linkCanceled {
+		t.Errorf("job in progress => %+v, expect link canceled after drain timeout", job)
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	defer func(limit float64, burst int, host string) { rateLimit, rateBurst, readyDNSHost = limit, burst, host }(rateLimit, rateBurst, readyDNSHost)
+	rateLimit, rateBurst = 0.001, 1
+	hash := sha256.Sum256([]byte("key"))
+	file, err := ioutil.TempFile("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`[{"name": "key", "secret_sha256": "` + hex.EncodeToString(hash[:]) + `", "scopes": ["parse"]}]`)
+	file.Close()
+	if err := apiKeys.load(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		apiKeys.mutex.Lock()
+		apiKeys.keys = nil
+		apiKeys.mutex.Unlock()
+		service.mutex.Lock()
+		service.started, service.warm, service.draining = false, false, false
+		service.mutex.Unlock()
+	}()
+
+	probe := func(path string) (int, HealthResponse) {
+		var response HealthResponse
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+	for i := 0; i < 3; i++ {
+		if code, response := probe("/healthz"); code != http.StatusOK || response.Status != healthOK {
+			t.Errorf("/healthz #%d => %d %+v, expect %d ok", i+1, code, response, http.StatusOK)
+		}
+	}
+
+	tests := []struct {
+		setup  func()
+		code   int
+		failed string
+	}{
+		{func() {}, http.StatusServiceUnavailable, "caches,config"},
+		{func() { service.markStarted() }, http.StatusServiceUnavailable, "caches"},
+		{func() { warmUp("") }, http.StatusOK, ""},
+		{func() { readyDNSHost = "localhost" }, http.StatusOK, ""},
+		{func() { readyDNSHost = "nonexistent.invalid" }, http.StatusServiceUnavailable, "dns"},
+		{func() {
+			readyDNSHost = ""
+			service.mutex.Lock()
+			service.draining = true
+			service.mutex.Unlock()
+		}, http.StatusServiceUnavailable, "shutdown"},
+	}
+	for i, test := range tests {
+		test.setup()
+		code, response := probe("/readyz")
+		failed := []string{}
+		for name, c := range response.Checks {
+			if c.Status != healthOK {
+				failed = append(failed, name)
+			}
+		}
+		sort.Strings(failed)
+		if code != test.code || strings.Join(failed, ",") != test.failed {
+			t.Errorf("/readyz #%d => %d %+v, expect %d with failed %q", i+1, code, response, test.code, test.failed)
+		}
+	}
+}
+
+// writeTestCert generates a certificate for 127.0.0.1 signed by the parent
+// (self-signed if parent is nil) and writes it along with its key as PEM files
+func writeTestCert(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(dir+"/"+name+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(dir+"/"+name+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestTLSServing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := writeTestCert(t, dir, "ca", 1, nil, nil)
+	writeTestCert(t, dir, "server", 2, ca, caKey)
+	writeTestCert(t, dir, "client", 3, ca, caKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(dir+"/client.crt", dir+"/client.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newServerTLSConfig(dir+"/server.crt", "", "", ""); err == nil {
+		t.Errorf("%s(no key) => no error, expect one", getFunctionName(newServerTLSConfig))
+	}
+	if _, err := newServerTLSConfig(dir+"/server.crt", dir+"/server.key", dir+"/ca.crt", "sometimes"); err == nil {
+		t.Errorf("%s(unknown client auth) => no error, expect one", getFunctionName(newServerTLSConfig))
+	}
+
+	tests := []struct {
+		clientCA   string
+		clientAuth string
+		clientCert bool
+		ok         bool
+	}{
+		{"", "", false, true},
+		{dir + "/ca.crt", "require", false, false},
+		{dir + "/ca.crt", "require", true, true},
+		{dir + "/ca.crt", "request", false, true},
+	}
+	for _, test := range tests {
+		config, err := newServerTLSConfig(dir+"/server.crt", dir+"/server.key", test.clientCA, test.clientAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: apiRouter, TLSConfig: config}
+		go server.ServeTLS(l, "", "")
+
+		clientConfig := &tls.Config{RootCAs: roots}
+		if test.clientCert {
+			clientConfig.Certificates = []tls.Certificate{clientCert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig, ForceAttemptHTTP2: true}}
+		resp, err := client.Get("https://" + l.Addr().String() + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+		}
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("client CA %q, %s, client cert %v => %v, expect no error", test.clientCA, test.clientAuth, test.clientCert, err)
+		case test.ok && resp.ProtoMajor != 2:
+			t.Errorf("client CA %q, %s, client cert %v => %s, expect HTTP/2", test.clientCA, test.clientAuth, test.clientCert, resp.Proto)
+		case !test.ok && err == nil:
+			t.Errorf("client CA %q, %s, client cert %v => %d, expect handshake error", test.clientCA, test.clientAuth, test.clientCert, resp.StatusCode)
+		}
+		server.Close()
+	}
+
+	// certificate is reloaded once files change, broken files keep the old one
+	reloader, err := newCertReloader(dir+"/server.crt", dir+"/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		cert, _ := reloader.GetCertificate(nil)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.SerialNumber.Int64()
+	}
+	writeTestCert(t, dir, "server", 4, ca, caKey)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(dir+"/server.crt", future, future)
+	reloader.checked = time.Time{}
+	if s := serial(); s != 4 {
+		t.Errorf("certificate after change => serial %d, expect %d", s, 4)
+	}
+	ioutil.WriteFile(dir+"/server.crt", []byte("broken"), 0600)
+	os.Chtimes(dir+"/server.crt", future.Add(time.Minute), future.Add(time.Minute))
+	reloader.checked = time.Time{}
+	if s := serial(); s != 4 {
+		t.Errorf("certificate after broken change => serial %d, expect %d", s, 4)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	negotiations := []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"zstd;q=0, *", "br"},
+		{"*;q=0", ""},
+	}
+	for _, n := range negotiations {
+		if encoding := negotiateEncoding(n.acceptEncoding); encoding != n.encoding {
+			t.Errorf("%s(%q) => %q, expect %q", getFunctionName(negotiateEncoding), n.acceptEncoding, encoding, n.encoding)
+		}
+	}
+
+	mentions := []string{}
+	for i := 0; i < 200; i++ {
+		mentions = append(mentions, fmt.Sprintf("@user%d", i))
+	}
+	large := `{"message":"` + strings.Join(mentions, " ") + `"}`
+	small := `{"message":"@test"}`
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"": func(r io.Reader) (io.Reader, error) { return r, nil },
+		"gzip": func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		"br": func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+		"zstd": func(r io.Reader) (io.Reader, error) {
+			d, err := zstd.NewReader(r)
+			return d, err
+		},
+	}
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(large))
+	gz.Close()
+
+	tests := []struct {
+		body            string
+		contentEncoding string
+		acceptEncoding  string
+		code            int
+		encoding        string
+		mentions        int
+	}{
+		{large, "", "", http.StatusOK, "", 200},
+		{large, "", "gzip", http.StatusOK, "gzip", 200},
+		{large, "", "br", http.StatusOK, "br", 200},
+		{large, "", "zstd, gzip", http.StatusOK, "zstd", 200},
+		{small, "", "gzip", http.StatusOK, "", 1},
+		{gzipped.String(), "gzip", "gzip", http.StatusOK, "gzip", 200},
+		{large, "gzip", "", http.StatusBadRequest, "", 0},
+		{large, "compress", "", http.StatusUnsupportedMediaType, "", 0},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/api/v1/parse", strings.NewReader(test.body))
+		r.Header.Set("Content-Encoding", test.contentEncoding)
+		r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, r)
+		encoding := w.Header().Get("Content-Encoding")
+		if w.Code != test.code || encoding != test.encoding {
+			t.Errorf("POST %q (%q, accept %q) => %d %q, expect %d %q", test.body[:10], test.contentEncoding, test.acceptEncoding, w.Code, encoding, test.code, test.encoding)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		body, err := decoders[encoding](w.Body)
+		if err != nil {
+			t.Errorf("POST %q (%q, accept %q) => %v", test.body[:10], test.contentEncoding, test.acceptEncoding, err)
+			continue
+		}
+		var response ServiceResponse
+		if err := json.NewDecoder(body).Decode(&response); err != nil || len(response.Mentions) != test.mentions {
+			t.Errorf("POST %q (%q, accept %q) => %d mentions (%v), expect %d", test.body[:10], test.contentEncoding, test.acceptEncoding, len(response.Mentions), err, test.mentions)
+		}
+	}
+
+	// streamed events are compressed and flushed as they are written
+	r := httptest.NewRequest("POST", "/api/v1/parse", strings.NewReader(small))
+	r.Header.Set("Accept", streamNDJSON)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	apiRouter.ServeHTTP(w, r)
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" || !w.Flushed {
+		t.Errorf("POST %q (stream) => %q, flushed %v, expect %q flushed", small, encoding, w.Flushed, "gzip")
+	} else if body, err := gzip.NewReader(w.Body); err != nil {
+		t.Errorf("POST %q (stream) => %v", small, err)
+	} else if data, _ := ioutil.ReadAll(body); !strings.Contains(string(data), `"type":"done"`) {
+		t.Errorf("POST %q (stream) => %q, expect done event", small, data)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	post := func(path, body, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, r)
+		return w
+	}
+	for _, path := range []string{"/api/v1/parse", "/api/v1/parse/batch"} {
+		body := `{"message":"@test (smile)"}`
+		other := `{"message":"@other"}`
+		if path == "/api/v1/parse/batch" {
+			body = `{"messages":[{"id":"1","message":"@test (smile)"}]}`
+			other = `{"messages":[{"id":"1","message":"@other"}]}`
+		}
+		first := post(path, body, "")
+		tag := first.Header().Get("ETag")
+		if first.Code != http.StatusOK || !strings.HasPrefix(tag, `W/"`) {
+			t.Fatalf("POST %s => %d, ETag %q, expect %d with weak ETag", path, first.Code, tag, http.StatusOK)
+		}
+		tests := []struct {
+			body        string
+			ifNoneMatch string
+			code        int
+		}{
+			{body, tag, http.StatusNotModified},
+			{body, `"other", ` + tag, http.StatusNotModified},
+			{body, strings.TrimPrefix(tag, "W/"), http.StatusNotModified},
+			{body, "*", http.StatusNotModified},
+			{body, `"other"`, http.StatusOK},
+			{other, tag, http.StatusOK},
+		}
+		for _, test := range tests {
+			w := post(path, test.body, test.ifNoneMatch)
+			if w.Code != test.code {
+				t.Errorf("POST %s %q (If-None-Match %s) => %d, expect %d", path, test.body, test.ifNoneMatch, w.Code, test.code)
+			}
+			if test.code == http.StatusNotModified && (w.Body.Len() != 0 || w.Header().Get("ETag") != tag) {
+				t.Errorf("POST %s %q (If-None-Match %s) => %q, ETag %q, expect no body and ETag %q", path, test.body, test.ifNoneMatch, w.Body.String(), w.Header().Get("ETag"), tag)
+			}
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	// every handler should be documented and every spec entry should have a handler
+	registered := make(map[string]bool)
+	for _, h := range RESTHandlers {
+		key := h.Method + " " + h.Path
+		registered[key] = true
+		if op, ok := apiOperations[key]; !ok || op.Summary == "" || len(op.Responses) == 0 {
+			t.Errorf("%s (%s) has no spec entry with summary and responses in apiOperations", key, getFunctionName(h.Handler))
+		}
+	}
+	for key := range apiOperations {
+		if !registered[key] {
+			t.Errorf("apiOperations entry %s has no handler in RESTHandlers", key)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	apiRouter.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	var doc struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("GET /openapi.json => %d %v, expect %d with JSON", w.Code, err, http.StatusOK)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("GET /openapi.json => openapi %q, expect 3.x", doc.OpenAPI)
+	}
+	for _, h := range RESTHandlers {
+		if _, ok := doc.Paths[h.Path][strings.ToLower(h.Method)]; !ok {
+			t.Errorf("GET /openapi.json => no operation %s %s", h.Method, h.Path)
+		}
+	}
+	params, _ := doc.Paths["/api/v1/jobs/{id}"]["get"]["parameters"].([]interface{})
+	if len(params) == 0 || params[0].(map[string]interface{})["in"] != "path" || params[0].(map[string]interface{})["name"] != "id" {
+		t.Errorf("GET /openapi.json => /api/v1/jobs/{id} parameters %v, expect id in path", params)
+	}
+	for _, name := range []string{"IM", "ParseOptions", "ServiceResponse", "URLResponse", "BatchIM", "JobResponse", "ErrorResponse", "APIError"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("GET /openapi.json => no %s schema", name)
+		}
+	}
+	status, _ := doc.Components.Schemas["URLResponse"]["properties"].(map[string]interface{})["status"].(map[string]interface{})
+	if enum, _ := status["enum"].([]interface{}); len(enum) == 0 {
+		t.Errorf("GET /openapi.json => URLResponse.status %v, expect enum of link statuses", status)
+	}
+	// every reference should be resolved by components
+	for _, ref := range regexp.MustCompile(`"\$ref": "#/components/schemas/(\w+)"`).FindAllStringSubmatch(w.Body.String(), -1) {
+		if _, ok := doc.Components.Schemas[ref[1]]; !ok {
+			t.Errorf("GET /openapi.json => unresolved reference %s", ref[0])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	apiRouter.ServeHTTP(w, httptest.NewRequest("GET", "/docs", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "/openapi.json") {
+		t.Errorf("GET /docs => %d %q, expect %d html page of /openapi.json", w.Code, w.Header().Get("Content-Type"), http.StatusOK)
+	}
+	// the page is self-contained, nothing but its inline script and style may run
+	if asset := regexp.MustCompile(`(?:src|href)="[^"]+"`).FindString(w.Body.String()); asset != "" {
+		t.Errorf("GET /docs => asset %s, expect self-contained page", asset)
+	}
+	if policy := w.Header().Get("Content-Security-Policy"); !strings.Contains(policy, "script-src 'sha256-") || !strings.Contains(policy, "style-src 'sha256-") {
+		t.Errorf("GET /docs => Content-Security-Policy %q, expect inline script and style hashes only", policy)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	for _, origins := range []string{"example.com", "https://example.com/path", "https://a.*.example.com"} {
+		if _, err := newCORSPolicy(corsSettings{origins: origins}); err == nil {
+			t.Errorf("%s(%q) => no error, expect one", getFunctionName(newCORSPolicy), origins)
+		}
+	}
+	if _, err := newCORSPolicy(corsSettings{origins: "https://app.example.com, *", credentials: true}); err == nil {
+		t.Errorf("%s(* with credentials) => no error, expect one", getFunctionName(newCORSPolicy))
+	}
+	if p, err := newCORSPolicy(corsSettings{}); p != nil || err != nil {
+		t.Errorf("%s(no origins) => %v %v, expect nil (disabled)", getFunctionName(newCORSPolicy), p, err)
+	}
+
+	defer func() { cors = nil }()
+	tests := []struct {
+		settings corsSettings
+		method   string
+		path     string
+		headers  map[string]string
+		code     int
+		expect   map[string]string // expected response headers, empty value - no header
+	}{
+		// disabled
+		{corsSettings{}, "GET", "/healthz", map[string]string{"Origin": "https://app.example.com"},
+			http.StatusOK, map[string]string{"Access-Control-Allow-Origin": ""}},
+		// exact and wildcard origins
+		{corsSettings{origins: "https://app.example.com"}, "GET", "/healthz", map[string]string{"Origin": "https://app.example.com"},
+			http.StatusOK, map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Expose-Headers": corsExposedHeaders, "Vary": "Origin"}},
+		{corsSettings{origins: "https://app.example.com"}, "GET", "/healthz", map[string]string{"Origin": "https://evil.com"},
+			http.StatusOK, map[string]string{"Access-Control-Allow-Origin": "", "Vary": "Origin"}},
+		{corsSettings{origins: "https://*.example.com"}, "GET", "/healthz", map[string]string{"Origin": "https://a.b.example.com"},
+			http.StatusOK, map[string]string{"Access-Control-Allow-Origin": "https://a.b.example.com"}},
+		{corsSettings{origins: "https://*.example.com"}, "GET", "/healthz", map[string]string{"Origin": "https://example.com"},
+			http.StatusOK, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{corsSettings{origins: "https://*.example.com"}, "GET", "/healthz", map[string]string{"Origin": "http://a.example.com"},
+			http.StatusOK, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{corsSettings{origins: "https://*.example.com"}, "GET", "/healthz", map[string]string{"Origin": "https://a.example.com.evil.com"},
+			http.StatusOK, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{corsSettings{origins: "*"}, "GET", "/healthz", map[string]string{"Origin": "https://any.com"},
+			http.StatusOK, map[string]string{"Access-Control-Allow-Origin": "*", "Access-Control-Allow-Credentials": ""}},
+		{corsSettings{origins: "https://app.example.com", credentials: true}, "GET", "/healthz", map[string]string{"Origin": "https://app.example.com"},
+			http.StatusOK, map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Allow-Credentials": "true"}},
+		// errors are readable by allowed origins as well
+		{corsSettings{origins: "*"}, "GET", "/nowhere", map[string]string{"Origin": "https://any.com"},
+			http.StatusNotFound, map[string]string{"Access-Control-Allow-Origin": "*"}},
+		// preflight
+		{corsSettings{origins: "https://app.example.com", maxAge: time.Minute}, "OPTIONS", "/api/v1/parse",
+			map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "content-type, authorization"},
+			http.StatusNoContent, map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Allow-Methods": "POST",
+				"Access-Control-Allow-Headers": "content-type, authorization", "Access-Control-Max-Age": "60", "Access-Control-Expose-Headers": ""}},
+		{corsSettings{origins: "https://app.example.com"}, "OPTIONS", "/api/v1/parse",
+			map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "PUT"},
+			http.StatusNoContent, map[string]string{"Access-Control-Allow-Origin": "", "Allow": "OPTIONS, POST"}},
+		{corsSettings{origins: "https://app.example.com"}, "OPTIONS", "/api/v1/parse",
+			map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "X-Custom"},
+			http.StatusNoContent, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{corsSettings{origins: "https://app.example.com", headers: "X-Custom"}, "OPTIONS", "/api/v1/parse",
+			map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "X-Custom"},
+			http.StatusNoContent, map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Allow-Headers": "X-Custom"}},
+		{corsSettings{origins: "https://app.example.com", methods: "GET"}, "OPTIONS", "/api/v1/parse",
+			map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST"},
+			http.StatusNoContent, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{corsSettings{origins: "https://app.example.com"}, "OPTIONS", "/api/v1/jobs/1",
+			map[string]string{"Origin": "https://evil.com", "Access-Control-Request-Method": "GET"},
+			http.StatusNoContent, map[string]string{"Access-Control-Allow-Origin": "", "Allow": "GET, HEAD, OPTIONS"}},
+	}
+	for _, test := range tests {
+		if test.settings.headers == "" {
+			test.settings.headers = corsConfig.headers
+		}
+		var err error
+		if cors, err = newCORSPolicy(test.settings); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(test.method, test.path, nil)
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s %v (%+v) => %d, expect %d", test.method, test.path, test.headers, test.settings, w.Code, test.code)
+		}
+		for name, value := range test.expect {
+			if got := strings.Join(w.Header()[name], ", "); got != value && !(name == "Vary" && strings.Contains(got, value)) {
+				t.Errorf("%s %s %v (%+v) => %s %q, expect %q", test.method, test.path, test.headers, test.settings, name, got, value)
+			}
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		path string
+		id   string
+		same bool // whether the id should be kept
+	}{
+		{"/healthz", "", false},
+		{"/healthz", "client-id.42:a/b+c=", true},
+		{"/nowhere", "client-id-43", true},
+		{"/healthz", "bad id", false},
+		{"/healthz", strings.Repeat("x", 129), false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.id != "" {
+			r.Header.Set("X-Request-ID", test.id)
+		}
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, r)
+		id := w.Header().Get("X-Request-ID")
+		if id == "" || (id == test.id) != test.same {
+			t.Errorf("GET %s (X-Request-ID %q) => %q, expect same id %v", test.path, test.id, id, test.same)
+		}
+		var e ErrorResponse
+		if json.Unmarshal(w.Body.Bytes(), &e); w.Code == http.StatusNotFound && e.Error.RequestID != id {
+			t.Errorf("GET %s (X-Request-ID %q) => error envelope request_id %q, expect %q", test.path, test.id, e.Error.RequestID, id)
+		}
+	}
+
+	// the id is attached to the log line, in-progress fetches
+	// and (if configured) forwarded on outbound fetches
+	defer func(header string) { fetchConfig.requestIDHeader = header }(fetchConfig.requestIDHeader)
+	var forwarded, inProgress []string
+	var mutex sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		global.mutex.Lock()
+		tag := strings.Join(global.fetchInProgress["http://"+r.Host+r.URL.Path], ",")
+		global.mutex.Unlock()
+		mutex.Lock()
+		forwarded = append(forwarded, r.Header.Get("X-Request-ID"))
+		inProgress = append(inProgress, tag)
+		mutex.Unlock()
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer ts.Close()
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	for _, header := range []string{"", "X-Request-ID"} {
+		fetchConfig.requestIDHeader = header
+		forwarded, inProgress = nil, nil
+		logs.Reset()
+		r := httptest.NewRequest("POST", "/api/v1/parse", strings.NewReader(`{"message":"`+ts.URL+`/page"}`))
+		r.Header.Set("X-Request-ID", "parse-request-1")
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, r)
+		expect := ""
+		if header != "" {
+			expect = "parse-request-1"
+		}
+		if w.Code != http.StatusOK || len(forwarded) != 1 || forwarded[0] != expect || inProgress[0] != "parse-request-1" {
+			t.Errorf("POST /api/v1/parse (forward %q) => %d, forwarded %q, in progress %q, expect %d, %q, %q",
+				header, w.Code, forwarded, inProgress, http.StatusOK, expect, "parse-request-1")
+		}
+		if !strings.Contains(logs.String(), "parse-request-1\tPOST\t/api/v1/parse") {
+			t.Errorf("POST /api/v1/parse => log %q, expect request id", logs.String())
+		}
+	}
+
+	// the same url fetched for two requests at once is attributed to both
+	arrived, release := make(chan struct{}, 2), make(chan struct{})
+	shared := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		fmt.Fprintln(w, "<html><title>My title</title></html>")
+	}))
+	defer shared.Close()
+	var wg sync.WaitGroup
+	for _, id := range []string{"parse-request-2", "parse-request-3"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			r := httptest.NewRequest("POST", "/api/v1/parse", strings.NewReader(`{"message":"`+shared.URL+`/page"}`))
+			r.Header.Set("X-Request-ID", id)
+			apiRouter.ServeHTTP(httptest.NewRecorder(), r)
+		}(id)
+	}
+	<-arrived
+	<-arrived
+	global.mutex.Lock()
+	ids := append([]string{}, global.fetchInProgress[shared.URL+"/page"]...)
+	global.mutex.Unlock()
+	sort.Strings(ids)
+	close(release)
+	wg.Wait()
+	if fmt.Sprint(ids) != "[parse-request-2 parse-request-3]" {
+		t.Errorf("%q() => in progress %q, expect both request ids", getFunctionName(global.addURL), ids)
+	}
+	global.mutex.Lock()
+	left, ok := global.fetchInProgress[shared.URL+"/page"]
+	global.mutex.Unlock()
+	if ok {
+		t.Errorf("%q() => in progress %q, expect none once fetches are done", getFunctionName(global.removeURL), left)
+	}
+}
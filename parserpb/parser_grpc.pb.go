@@ -0,0 +1,223 @@
+// gRPC counterpart of the REST API, see grpc_server.go
+//
+// Go code is generated with:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative parser.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: parser.proto
+
+package parserpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Parser_Parse_FullMethodName       = "/parser.v1.Parser/Parse"
+	Parser_ParseBatch_FullMethodName  = "/parser.v1.Parser/ParseBatch"
+	Parser_StreamParse_FullMethodName = "/parser.v1.Parser/StreamParse"
+)
+
+// ParserClient is the client API for Parser service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Parser extracts mentions, emoticons and links from chat messages
+// and fetches titles of the links
+type ParserClient interface {
+	// Parse parses a single message
+	Parse(ctx context.Context, in *ParseRequest, opts ...grpc.CallOption) (*ParseResponse, error)
+	// ParseBatch parses many messages sharing link fetches between them,
+	// results are in the input order
+	ParseBatch(ctx context.Context, in *ParseBatchRequest, opts ...grpc.CallOption) (*ParseBatchResponse, error)
+	// StreamParse sends entities (with pending links) first and then
+	// every link as soon as it is processed
+	StreamParse(ctx context.Context, in *ParseRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ParseEvent], error)
+}
+
+type parserClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewParserClient(cc grpc.ClientConnInterface) ParserClient {
+	return &parserClient{cc}
+}
+
+func (c *parserClient) Parse(ctx context.Context, in *ParseRequest, opts ...grpc.CallOption) (*ParseResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ParseResponse)
+	err := c.cc.Invoke(ctx, Parser_Parse_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *parserClient) ParseBatch(ctx context.Context, in *ParseBatchRequest, opts ...grpc.CallOption) (*ParseBatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ParseBatchResponse)
+	err := c.cc.Invoke(ctx, Parser_ParseBatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *parserClient) StreamParse(ctx context.Context, in *ParseRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ParseEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Parser_ServiceDesc.Streams[0], Parser_StreamParse_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ParseRequest, ParseEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Parser_StreamParseClient = grpc.ServerStreamingClient[ParseEvent]
+
+// ParserServer is the server API for Parser service.
+// All implementations must embed UnimplementedParserServer
+// for forward compatibility.
+//
+// Parser extracts mentions, emoticons and links from chat messages
+// and fetches titles of the links
+type ParserServer interface {
+	// Parse parses a single message
+	Parse(context.Context, *ParseRequest) (*ParseResponse, error)
+	// ParseBatch parses many messages sharing link fetches between them,
+	// results are in the input order
+	ParseBatch(context.Context, *ParseBatchRequest) (*ParseBatchResponse, error)
+	// StreamParse sends entities (with pending links) first and then
+	// every link as soon as it is processed
+	StreamParse(*ParseRequest, grpc.ServerStreamingServer[ParseEvent]) error
+	mustEmbedUnimplementedParserServer()
+}
+
+// UnimplementedParserServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedParserServer struct{}
+
+func (UnimplementedParserServer) Parse(context.Context, *ParseRequest) (*ParseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Parse not implemented")
+}
+func (UnimplementedParserServer) ParseBatch(context.Context, *ParseBatchRequest) (*ParseBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ParseBatch not implemented")
+}
+func (UnimplementedParserServer) StreamParse(*ParseRequest, grpc.ServerStreamingServer[ParseEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamParse not implemented")
+}
+func (UnimplementedParserServer) mustEmbedUnimplementedParserServer() {}
+func (UnimplementedParserServer) testEmbeddedByValue()                {}
+
+// UnsafeParserServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ParserServer will
+// result in compilation errors.
+type UnsafeParserServer interface {
+	mustEmbedUnimplementedParserServer()
+}
+
+func RegisterParserServer(s grpc.ServiceRegistrar, srv ParserServer) {
+	// If the following call pancis, it indicates UnimplementedParserServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Parser_ServiceDesc, srv)
+}
+
+func _Parser_Parse_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ParseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ParserServer).Parse(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Parser_Parse_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ParserServer).Parse(ctx, req.(*ParseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Parser_ParseBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ParseBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ParserServer).ParseBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Parser_ParseBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ParserServer).ParseBatch(ctx, req.(*ParseBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Parser_StreamParse_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ParseRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ParserServer).StreamParse(m, &grpc.GenericServerStream[ParseRequest, ParseEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Parser_StreamParseServer = grpc.ServerStreamingServer[ParseEvent]
+
+// Parser_ServiceDesc is the grpc.ServiceDesc for Parser service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Parser_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "parser.v1.Parser",
+	HandlerType: (*ParserServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Parse",
+			Handler:    _Parser_Parse_Handler,
+		},
+		{
+			MethodName: "ParseBatch",
+			Handler:    _Parser_ParseBatch_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamParse",
+			Handler:       _Parser_StreamParse_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "parser.proto",
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// max # of token buckets kept before idle ones are dropped
+const maxRateBuckets = 10000
+
+// tokenBucket limits rate of requests of a single client
+type tokenBucket struct {
+	tokens float64   // tokens available (up to rateBurst)
+	last   time.Time // time tokens were updated
+}
+
+// loadLimiter protects the service from request floods:
+// - per client IP token buckets (rateLimit requests/s, rateBurst at once)
+// - cap on # of concurrent heavy (parsing) requests (maxInFlight)
+// - shedding of heavy requests while fetch queue is too slow (shedQueueWait)
+type loadLimiter struct {
+	mutex    *sync.Mutex
+	buckets  map[string]*tokenBucket
+	inFlight int
+	expLoad  *expvar.Map // instrumentation: in-flight requests and rejections
+}
+
+var limiter loadLimiter
+
+// ipNets collects comma-separated CIDRs (or IPs) cmd-line flag
+type ipNets []*net.IPNet
+
+func (n *ipNets) String() string {
+	s := []string{}
+	for _, ipNet := range *n {
+		s = append(s, ipNet.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (n *ipNets) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("%q is neither IP nor CIDR", s)
+		}
+		*n = append(*n, ipNet)
+	}
+	return nil
+}
+
+// contains reports whether the ip belongs to any of the networks
+func (n ipNets) contains(ip net.IP) bool {
+	for _, ipNet := range n {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns IP of the client. X-Forwarded-For (and X-Real-IP)
+// are honored only if the request came from a trusted proxy, the client
+// is the rightmost address of the chain not belonging to trusted proxies
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxies.contains(ip) {
+		return host
+	}
+
+	chain := []string{}
+	for _, v := range r.Header["X-Forwarded-For"] {
+		chain = append(chain, strings.Split(v, ",")...)
+	}
+	if len(chain) == 0 && r.Header.Get("X-Real-IP") != "" {
+		chain = append(chain, r.Header.Get("X-Real-IP"))
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		forwarded := net.ParseIP(strings.TrimSpace(chain[i]))
+		if forwarded == nil {
+			break // malformed chain, do not trust the rest of it
+		}
+		host = forwarded.String()
+		if !trustedProxies.contains(forwarded) {
+			break
+		}
+	}
+	return host
+}
+
+// allow takes a token from the client's bucket, if there is none
+// it returns time till the next token is available
+func (l *loadLimiter) allow(client string) (time.Duration, bool) {
+	if rateLimit <= 0 {
+		return 0, true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.dropIdleBuckets(now)
+		}
+		b = &tokenBucket{tokens: float64(rateBurst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(rateBurst), b.tokens+now.Sub(b.last).Seconds()*rateLimit)
+	b.last = now
+	if b.tokens < 1 {
+		l.expLoad.Add("rate_limited", 1)
+		return time.Duration((1 - b.tokens) / rateLimit * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// dropIdleBuckets removes buckets that are full already, if there are
+// still too many of them the least recently used one is dropped
+// (mutex should be held)
+func (l *loadLimiter) dropIdleBuckets(now time.Time) {
+	oldest := ""
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rateLimit >= float64(rateBurst) {
+			delete(l.buckets, client)
+		} else if oldest == "" || b.last.Before(l.buckets[oldest].last) {
+			oldest = client
+		}
+	}
+	if len(l.buckets) >= maxRateBuckets {
+		delete(l.buckets, oldest)
+	}
+}
+
+// acquire reserves an in-flight slot for a heavy request unless
+// the service is overloaded, release should be called once it is done
+func (l *loadLimiter) acquire() *apiError {
+	if wait := global.queueWait(); shedQueueWait > 0 && wait > shedQueueWait {
+		l.expLoad.Add("shed", 1)
+		err := newAPIError(http.StatusServiceUnavailable, "overloaded", "service is overloaded, try again later")
+		err.details = map[string]string{"reason": "fetch queue wait is " + wait.Round(time.Millisecond).String()}
+		err.retryAfter = wait
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if maxInFlight > 0 && l.inFlight >= maxInFlight {
+		l.expLoad.Add("shed", 1)
+		err := newAPIError(http.StatusServiceUnavailable, "overloaded", "service is overloaded, try again later")
+		err.details = map[string]interface{}{"reason": "too many requests in flight", "max_in_flight": maxInFlight}
+		err.retryAfter = time.Second
+		return err
+	}
+	l.inFlight++
+	l.expLoad.Add("in_flight", 1)
+	return nil
+}
+
+// release frees the slot reserved by acquire
+func (l *loadLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inFlight--
+	l.expLoad.Add("in_flight", -1)
+}
+
+// limitRate is a decorator that rejects requests of clients
+// exceeding rateLimit with 429
+func limitRate(inner http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait, ok := limiter.allow(clientIP(r)); !ok {
+			err := newAPIError(http.StatusTooManyRequests, "rate_limited", "too many requests, slow down")
+			err.retryAfter = wait
+			writeError(w, r, err)
+			return
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// loadSlot is an in-flight slot reserved by limitLoad for the request
+type loadSlot struct {
+	taken bool // slot is taken over by work outliving the request
+}
+
+// loadSlotKey is the context key of *loadSlot
+type loadSlotKey struct{}
+
+// limitLoad is a decorator of heavy handlers that rejects requests
+// with 503 while the service is overloaded
+func limitLoad(inner http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := limiter.acquire(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		slot := &loadSlot{}
+		defer func() {
+			if !slot.taken {
+				limiter.release()
+			}
+		}()
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loadSlotKey{}, slot)))
+	})
+}
+
+// takeLoadSlot takes over the slot reserved by limitLoad for work that
+// outlives the request (e.g. async jobs), the returned function frees it.
+// It should be called by the handler goroutine
+func takeLoadSlot(ctx context.Context) func() {
+	slot, _ := ctx.Value(loadSlotKey{}).(*loadSlot)
+	if slot == nil || slot.taken {
+		return func() {}
+	}
+	slot.taken = true
+	return limiter.release
+}
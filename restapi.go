@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -16,18 +17,78 @@ import (
 type restHandler struct {
 	Path    string           `json:"path"`
 	Method  string           `json:"method"`
+	Scope   string           `json:"scope,omitempty"` // scope of API key required (empty - public)
+	Heavy   bool             `json:"-"`               // subject to in-flight cap and load shedding
+	Probe   bool             `json:"-"`               // health probe, not subject to rate limiting
 	Handler http.HandlerFunc `json:"-"`
 }
 
 // IM is represents input message structure
 type IM struct {
-	Msg string `json:"message"`
+	Msg         string        `json:"message"`
+	CallbackURL string        `json:"callback_url,omitempty"`
+	Options     *ParseOptions `json:"options,omitempty"`
 }
 
 // URLResponse represents url:title pair in output struct
+// along with the status of link processing
 type URLResponse struct {
-	URL   string `json:"url"`
-	Title string `json:"title"`
+	URL          string        `json:"url"`
+	Title        string        `json:"title"`
+	Status       string        `json:"status"`
+	StatusCode   int           `json:"status_code,omitempty"`
+	FinalURL     string        `json:"final_url,omitempty"`
+	CanonicalURL string        `json:"canonical_url,omitempty"`
+	Redirects    []RedirectHop `json:"redirects,omitempty"`
+	FTP          *FTPInfo      `json:"ftp,omitempty"`
+	Message      string        `json:"message,omitempty"`
+	Attempts     int           `json:"attempts"`
+
+	fields []string // fields to encode (nil - all), see ParseOptions
+}
+
+// RedirectHop represents a single redirect followed to reach the final url
+type RedirectHop struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code"`
+}
+
+// FTPInfo describes file or directory an ftp:// link points to
+type FTPInfo struct {
+	Name     string     `json:"name"`
+	IsDir    bool       `json:"is_dir"`
+	Size     int64      `json:"size,omitempty"`
+	Modified *time.Time `json:"modified,omitempty"`
+	Entries  []string   `json:"entries,omitempty"`
+}
+
+// newURLResponse converts link processing result into output struct
+func newURLResponse(r linkProcessingResult) URLResponse {
+	response := URLResponse{
+		URL:          r.url,
+		Title:        r.title,
+		Status:       r.status,
+		StatusCode:   r.statusCode,
+		FinalURL:     r.finalURL,
+		CanonicalURL: r.canonicalURL,
+		Message:      r.message,
+		Attempts:     r.attempts,
+	}
+	if r.ftp != nil {
+		response.FTP = &FTPInfo{
+			Name:    r.ftp.name,
+			IsDir:   r.ftp.isDir,
+			Size:    r.ftp.size,
+			Entries: r.ftp.entries,
+		}
+		if !r.ftp.modified.IsZero() {
+			response.FTP.Modified = &r.ftp.modified
+		}
+	}
+	for _, hop := range r.redirects {
+		response.Redirects = append(response.Redirects, RedirectHop{hop.url, hop.statusCode})
+	}
+	return response
 }
 
 // ServiceResponse - output struct
@@ -37,30 +98,105 @@ type ServiceResponse struct {
 	Links     []URLResponse `json:"links"`
 }
 
+// fetchLinks fetches every distinct link once and returns
+// results by url, fetches are tagged with request id of ctx
+// (they are not canceled along with ctx though)
+func fetchLinks(ctx context.Context, links []string) map[string]URLResponse {
+	return fetchLinksWithOptions(ctx, links, nil)
+}
+
+// fetchLinksWithOptions fetches links selected by parsing
+// options and returns results by url
+func fetchLinksWithOptions(ctx context.Context, links []string, options *ParseOptions) map[string]URLResponse {
+	unique := options.linksToFetch(links)
+	results := make(map[string]URLResponse, len(unique))
+	for r := range processLinksWithOptions(context.WithoutCancel(ctx), unique, options.fetchOptions()) {
+		results[r.url] = newURLResponse(r)
+	}
+	return results
+}
+
+// uniqueLinks returns distinct links in order of their appearance
+func uniqueLinks(links []string) []string {
+	unique := []string{}
+	seen := make(map[string]bool)
+	for _, link := range links {
+		if !seen[link] {
+			seen[link] = true
+			unique = append(unique, link)
+		}
+	}
+	return unique
+}
+
+// newServiceResponse parses the message and constructs output,
+// links are reported in order of their appearance in the message
+// using already fetched results (links not fetched are reported as skipped)
+func newServiceResponse(msg string, fetched map[string]URLResponse) ServiceResponse {
+	links := []URLResponse{}
+	for _, link := range parseLinks(msg) {
+		r, ok := fetched[link]
+		if !ok {
+			r = URLResponse{URL: link, Status: linkSkipped, Message: "link is not fetched as requested by options"}
+		}
+		links = append(links, r)
+	}
+	return ServiceResponse{
+		Mentions:  parseMentions(msg),
+		Emoticons: parseEmoticons(msg),
+		Links:     links,
+	}
+}
+
 // RESTHandlers contains a list of all handlers registered in the system
 var RESTHandlers []restHandler
 
+// apiRouter dispatches requests to RESTHandlers
+var apiRouter *router
+
 func init() {
 	RESTHandlers = []restHandler{
 		restHandler{
 			Path: "/", Method: "GET", Handler: defaultHandler,
 		},
 		restHandler{
-			Path: "/api/v1/parse", Method: "POST", Handler: doParsingHandler,
+			Path: "/api/v1/parse", Method: "POST", Scope: scopeParse, Heavy: true, Handler: doParsingHandler,
+		},
+		restHandler{
+			Path: "/api/v1/parse/batch", Method: "POST", Scope: scopeParse, Heavy: true, Handler: doBatchParsingHandler,
+		},
+		restHandler{
+			Path: "/api/v1/jobs/{id}", Method: "GET", Scope: scopeParse, Handler: doJobStatusHandler,
+		},
+		restHandler{
+			Path: "/api/v1/ws", Method: "GET", Scope: scopeParse, Handler: doWebSocketHandler,
 		},
 		restHandler{
-			Path: "/bulktest", Method: "GET", Handler: doBulkTestHandler,
+			Path: "/bulktest", Method: "GET", Scope: scopeSelftest, Handler: doBulkTestHandler,
 		},
 		restHandler{
-			Path: "/selftest", Method: "GET", Handler: doSelfTestHandler,
+			Path: "/selftest", Method: "GET", Scope: scopeSelftest, Handler: doSelfTestHandler,
+		},
+		restHandler{
+			Path: "/healthz", Method: "GET", Probe: true, Handler: doHealthzHandler,
+		},
+		restHandler{
+			Path: "/readyz", Method: "GET", Probe: true, Handler: doReadyzHandler,
+		},
+		restHandler{
+			Path: "/openapi.json", Method: "GET", Handler: doOpenAPIHandler,
+		},
+		restHandler{
+			Path: "/docs", Method: "GET", Handler: doDocsHandler,
+		},
+		restHandler{
+			Path: "/debug/vars", Method: "GET", Scope: scopeAdmin, Handler: doDebugVarsHandler,
 		},
 	}
 
-	for _, handler := range RESTHandlers {
-		http.HandleFunc(
-			handler.Path,
-			addLogging(handler.Handler, getFunctionName(handler.Handler)))
-	}
+	// router serves the API, DefaultServeMux is not used (expvar
+	// registers unauthenticated /debug/vars there)
+	apiRouter = newRouter(RESTHandlers, defaultHandler)
 }
 
 // getFunctionName returns name of the function passed as a parameter
@@ -68,18 +204,24 @@ func getFunctionName(i interface{}) string {
 	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
 }
 
-// defaultHandler is used as a 'default' in cases when requested uri
-// does not match with any registered handlers. It just sends back
-// a list of registerd rest endpoints
+// defaultHandler serves the root and is used as a 'default' in cases when
+// requested uri does not match with any registered handlers. It just sends
+// back a list of registerd rest endpoints
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		err := newAPIError(http.StatusNotFound, "not_found", "no handler for "+r.URL.Path)
+		err.details = RESTHandlers
+		writeError(w, r, err)
+		return
+	}
+
 	// set return type as json to allow automatic processing
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-
-	w.WriteHeader(http.StatusNotImplemented) // 501 RFC2616 https://www.w3.org/Protocols/rfc2616/rfc2616-sec10.html
+	w.WriteHeader(http.StatusOK)
 
 	// return a list of available endpoints
 	if err := json.NewEncoder(w).Encode(RESTHandlers); err != nil {
-		Error.Println(err)
+		Error.Println(requestID(r), err)
 	}
 }
 
@@ -89,50 +231,39 @@ func doParsingHandler(w http.ResponseWriter, r *http.Request) {
 
 	defer r.Body.Close() // free resurces in any case
 
-	// read input payload, set upper limit to 1M to avoid overload
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
-	if err != nil {
-		Error.Println(err)
+	// read and decode input payload, upper limit is set to avoid overload
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := payload.Options.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := chargeFetches(r.Context(), len(payload.Options.linksToFetch(parseLinks(payload.Msg)))); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	// set return type as json to allow automatic processing
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-
-	// try to decode payload
-	if err := json.Unmarshal(body, &payload); err != nil {
-		// unprocessable entity,
-		// http://www.restpatterns.org/HTTP_Status_Codes/422_-_Unprocessable_Entit
-		w.WriteHeader(422)
-		if err := json.NewEncoder(w).Encode(err); err != nil {
-			Error.Println(err)
-		}
+	// client might ask to process the message in background
+	// (the result is polled or delivered to callback url)
+	if isAsync(r) || payload.CallbackURL != "" {
+		startParsingJob(w, r, payload)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	// client might ask to send link results as soon as they are available
+	if format := streamFormat(r); format != "" {
+		streamParsing(w, r, payload.Msg, payload.Options, format)
+		return
+	}
 
-	// Call parsing methods
-	mentions := parseMentions(payload.Msg)
-	emoticons := parseEmoticons(payload.Msg)
+	// Call parsing methods and fetch titles
 	links := parseLinks(payload.Msg)
-	// fetch titles
-	out := processLinks(links)
-	// construct output
-	titles := []URLResponse{}
-	for r := range out {
-		titles = append(titles, URLResponse{r.url, r.title})
-	}
-	result := ServiceResponse{
-		Mentions:  mentions,
-		Emoticons: emoticons,
-		Links:     titles,
-	}
+	result := payload.Options.apply(newServiceResponse(payload.Msg, fetchLinksWithOptions(r.Context(), links, payload.Options)))
 
-	// return its result to a caller
-	if err := json.NewEncoder(w).Encode(result); err != nil {
-		Error.Println(err)
-	}
+	// return its result to a caller (304 if the caller has it already)
+	writeJSONWithETag(w, r, result)
 }
 
 var selftestURLSet = []string{
@@ -169,9 +300,12 @@ func doBulkTestHandler(w http.ResponseWriter, r *http.Request) {
 	out := processLinks(selftestURLSet)
 	result := ""
 	for r := range out {
-		s := fmt.Sprintf("%s | %s | Wait time: %sms | Fetch time: %sms\n",
+		s := fmt.Sprintf("%s | %s | %s %s | Attempts: %d | Wait time: %sms | Fetch time: %sms\n",
 			r.url,
+			r.status,
 			r.title,
+			r.message,
+			r.attempts,
 			r.endProcessingTime.Sub(r.queueingTime)/time.Millisecond,
 			r.endProcessingTime.Sub(r.startProcessingTime)/time.Millisecond)
 		result += s
@@ -189,24 +323,31 @@ func doSelfTestHandler(w http.ResponseWriter, r *http.Request) {
 	defer ts.Close()
 	request := `{ "message":"hey @here ` + ts.URL + ` is (Cool)" }`
 
-	url := "http://" + serviceAddr + "/api/v1/parse"
-	resp, err := http.Post(url, "application/json", strings.NewReader(request))
+	// the service calls itself, so its certificate (if any) is not verified
+	url, client := "http://"+serviceAddr+"/api/v1/parse", http.DefaultClient
+	if tlsCertFile != "" {
+		url = "https://" + serviceAddr + "/api/v1/parse"
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+	resp, err := client.Post(url, "application/json", strings.NewReader(request))
 	if err != nil {
-		w.Write([]byte(err.Error()))
+		writeError(w, r, newAPIError(http.StatusInternalServerError, "internal_error", err.Error()))
 		return
 	}
 	defer resp.Body.Close()
 	b, e := ioutil.ReadAll(resp.Body)
 	if e != nil {
-		w.Write([]byte(e.Error()))
+		writeError(w, r, newAPIError(http.StatusInternalServerError, "internal_error", e.Error()))
 		return
 	}
 	var output ServiceResponse
 	if err := json.Unmarshal(b, &output); err != nil {
-		w.Write([]byte(err.Error()))
+		writeError(w, r, newAPIError(http.StatusInternalServerError, "internal_error", err.Error()))
+		return
 	}
 
-	if output.Emoticons[0] == "Cool" && output.Mentions[0] == "here" && output.Links[0].URL == ts.URL && output.Links[0].Title == "Atlassian" {
+	if len(output.Emoticons) > 0 && len(output.Mentions) > 0 && len(output.Links) > 0 &&
+		output.Emoticons[0] == "Cool" && output.Mentions[0] == "here" && output.Links[0].URL == ts.URL && output.Links[0].Title == "Atlassian" {
 		w.Write([]byte("SelfTest - PASS"))
 	} else {
 		w.Write([]byte("SelfTest - FAIL"))
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/temoto/robotstxt"
+)
+
+// max # of hosts robots.txt policies are cached for
+const maxRobotsEntries = 10000
+
+// robotsEntry is a cached robots.txt policy of a single host
+type robotsEntry struct {
+	ready   chan struct{}         // closed once policy is fetched
+	data    *robotstxt.RobotsData // nil means everything is allowed
+	expires time.Time             // time the policy should be fetched again
+}
+
+// robotsCache keeps robots.txt policies of recently fetched hosts
+type robotsCache struct {
+	mutex *sync.Mutex
+	hosts map[string]*robotsEntry // key is scheme://host
+}
+
+var robots = robotsCache{
+	mutex: &sync.Mutex{},
+	hosts: make(map[string]*robotsEntry),
+}
+
+// robotsAgent returns product token of our user agent,
+// the one robots.txt groups and X-Robots-Tag are matched against
+func robotsAgent() string {
+	agent := fetchConfig.userAgent
+	if i := strings.IndexAny(agent, "/ "); i > 0 {
+		agent = agent[:i]
+	}
+	return agent
+}
+
+// allowed reports whether robots.txt of the link's host allows our agent
+// to fetch the link. Policy is fetched once per robotsCacheTTL (failed
+// fetches once per robotsRetryTTL), concurrent callers wait for the same
+// fetch. Missing or unreachable robots.txt allows everything, server
+// errors disallow everything
+func (c *robotsCache) allowed(ctx context.Context, link string) bool {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return true
+	}
+	key := u.Scheme + "://" + u.Host
+
+	c.mutex.Lock()
+	entry, ok := c.hosts[key]
+	if !ok || (isClosed(entry.ready) && time.Now().After(entry.expires)) {
+		if !ok && len(c.hosts) >= maxRobotsEntries {
+			c.evict(time.Now())
+		}
+		entry = &robotsEntry{ready: make(chan struct{})}
+		c.hosts[key] = entry
+		go entry.fetch(key + "/robots.txt")
+	}
+	c.mutex.Unlock()
+
+	select {
+	case <-entry.ready:
+	case <-ctx.Done():
+		return true // let the fetch itself report the timeout
+	}
+	return entry.data == nil || entry.data.TestAgent(u.RequestURI(), robotsAgent())
+}
+
+// evict drops expired policies, if there are still too many of them
+// arbitrary ones are dropped till there is room for a new one
+// (mutex should be held)
+func (c *robotsCache) evict(now time.Time) {
+	for key, entry := range c.hosts {
+		if isClosed(entry.ready) && now.After(entry.expires) {
+			delete(c.hosts, key)
+		}
+	}
+	for key, entry := range c.hosts {
+		if len(c.hosts) < maxRobotsEntries {
+			break
+		}
+		if isClosed(entry.ready) {
+			delete(c.hosts, key)
+		}
+	}
+}
+
+// fetch retrieves and parses robots.txt, the entry is ready afterwards.
+// It is fetched as any link is (host limits and circuit breaker apply)
+func (e *robotsEntry) fetch(robotsURL string) {
+	defer close(e.ready)
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	// failures (incl. server errors) are likely transient,
+	// so they are cached for robotsRetryTTL only
+	e.expires = time.Now().Add(robotsRetryTTL)
+	resp, err := fetchURL(ctx, &linkProcessingJob{url: robotsURL})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	data, err := robotstxt.FromResponse(resp)
+	if err != nil {
+		return
+	}
+	e.data = data
+	if resp.StatusCode < http.StatusInternalServerError {
+		e.expires = time.Now().Add(robotsCacheTTL)
+	}
+}
+
+// isClosed reports whether the channel is closed (without blocking)
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// xRobotsTagDirectives returns lower-cased directives of X-Robots-Tag
+// headers that apply to our agent, i.e. either without agent prefix
+// or with prefix matching robotsAgent ("agent: noindex, nofollow")
+func xRobotsTagDirectives(header http.Header) []string {
+	var result []string
+	for _, v := range header.Values("X-Robots-Tag") {
+		if i := strings.Index(v, ":"); i > 0 {
+			prefix := strings.TrimSpace(v[:i])
+			if !strings.ContainsAny(prefix, " ,") && !isRobotsDirective(prefix) {
+				if !strings.EqualFold(prefix, robotsAgent()) {
+					continue
+				}
+				v = v[i+1:]
+			}
+		}
+		result = append(result, splitRobotsDirectives(v)...)
+	}
+	return result
+}
+
+// isRobotsDirective reports whether the name is a robots directive
+// that might be followed by a colon (e.g. "unavailable_after: ...")
+func isRobotsDirective(name string) bool {
+	switch strings.ToLower(name) {
+	case "unavailable_after", "max-snippet", "max-image-preview", "max-video-preview":
+		return true
+	}
+	return false
+}
+
+// splitRobotsDirectives splits comma-separated directives
+func splitRobotsDirectives(v string) []string {
+	var result []string
+	for _, d := range strings.Split(v, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+// suppressesPreview reports whether the directives ask not to show
+// page snippets (title incl.)
+func suppressesPreview(directives []string) bool {
+	for _, d := range directives {
+		switch d {
+		case "noindex", "nosnippet", "none":
+			return true
+		}
+	}
+	return false
+}
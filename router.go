@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// router dispatches requests to handlers registered by path and method.
+// Path segments in curly braces ("/api/v1/jobs/{id}") are parameters,
+// their values are available to handlers via pathParam.
+// Besides that router
+// - responds 405 with Allow header if path matches but method does not
+// - serves HEAD by GET handler and OPTIONS with Allow header (unless registered)
+// - answers CORS preflight requests and adds CORS headers to all responses
+// - accepts (or generates) X-Request-ID and returns it in all responses
+// - passes requests with unknown path to notFound handler
+type router struct {
+	routes   []*route
+	notFound http.HandlerFunc
+}
+
+// route contains all handlers registered for the same path
+type route struct {
+	segments []string                    // path segments, "{name}" is a parameter
+	handlers map[string]http.HandlerFunc // handler per method
+}
+
+// pathParamsKey is the context key of path parameters map
+type pathParamsKey struct{}
+
+// newRouter creates router for the given handlers, each handler is wrapped
+// with logging, compression, rate limiting (except probes), load limiting
+// (heavy ones) and scope check, so shed requests are not charged to API keys
+func newRouter(handlers []restHandler, notFound http.HandlerFunc) *router {
+	rt := &router{notFound: addLogging(notFound, getFunctionName(notFound))}
+	byPath := make(map[string]*route)
+	for _, h := range handlers {
+		r, ok := byPath[h.Path]
+		if !ok {
+			r = &route{segments: splitPath(h.Path), handlers: make(map[string]http.HandlerFunc)}
+			byPath[h.Path] = r
+			rt.routes = append(rt.routes, r)
+		}
+		handler := requireScope(h.Handler, h.Scope)
+		if h.Heavy {
+			handler = limitLoad(handler)
+		}
+		if !h.Probe {
+			handler = limitRate(handler)
+		}
+		r.handlers[h.Method] = addLogging(compress(handler), getFunctionName(h.Handler))
+	}
+	return rt
+}
+
+// splitPath splits path into segments ignoring leading and trailing '/'
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// match checks whether the route matches given path segments and returns
+// values of path parameters along with # of matched literal segments
+func (r *route) match(segments []string) (map[string]string, int, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, 0, false
+	}
+	params := make(map[string]string)
+	literals := 0
+	for i, s := range r.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			params[s[1:len(s)-1]] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, 0, false
+		}
+		literals++
+	}
+	return params, literals, true
+}
+
+// allow returns sorted list of methods the route supports
+func (r *route) allow() []string {
+	methods := []string{"OPTIONS"}
+	for m := range r.handlers {
+		if m != "OPTIONS" {
+			methods = append(methods, m)
+		}
+	}
+	if _, ok := r.handlers["GET"]; ok {
+		if _, ok := r.handlers["HEAD"]; !ok {
+			methods = append(methods, "HEAD")
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// ServeHTTP implements http.Handler
+func (rt *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := incomingRequestID(req)
+	req = withRequestID(req, id)
+	w.Header().Set(requestIDHeader, id)
+	cors.apply(w, req)
+	// report panics of handlers as internal errors instead of dropping connection
+	defer func() {
+		if v := recover(); v != nil {
+			Error.Printf("%s %s %s: %v", id, req.Method, req.URL.Path, v)
+			writeError(w, req, newAPIError(http.StatusInternalServerError, "internal_error", "internal server error"))
+		}
+	}()
+
+	// the most specific route (with max # of literal segments) wins
+	segments := splitPath(req.URL.Path)
+	var best *route
+	var bestParams map[string]string
+	bestLiterals := -1
+	for _, r := range rt.routes {
+		if params, literals, ok := r.match(segments); ok && literals > bestLiterals {
+			best, bestParams, bestLiterals = r, params, literals
+		}
+	}
+	if best == nil {
+		rt.notFound(w, req)
+		return
+	}
+	if len(bestParams) > 0 {
+		req = req.WithContext(context.WithValue(req.Context(), pathParamsKey{}, bestParams))
+	}
+
+	if cors != nil && isPreflight(req) {
+		cors.preflight(w, req, best.allow())
+		return
+	}
+	if h, ok := best.handlers[req.Method]; ok {
+		h(w, req)
+		return
+	}
+	allow := strings.Join(best.allow(), ", ")
+	switch req.Method {
+	case "HEAD":
+		if h, ok := best.handlers["GET"]; ok {
+			h(headResponseWriter{w}, req)
+			return
+		}
+	case "OPTIONS":
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Allow", allow)
+	err := newAPIError(http.StatusMethodNotAllowed, "method_not_allowed", req.Method+" is not allowed for "+req.URL.Path)
+	err.details = map[string][]string{"allow": best.allow()}
+	writeError(w, req, err)
+}
+
+// pathParam returns value of the path parameter
+// (empty string if route has no such parameter)
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+// headResponseWriter discards response body, so GET handlers
+// can serve HEAD requests
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+)
+
+// websocket close status sent to clients on shutdown
+const wsGoingAway = 1001
+
+// lifecycle tracks readiness of the service and fetches in progress,
+// so they can be waited for (and canceled) on shutdown
+type lifecycle struct {
+	mutex     *sync.Mutex
+	startTime time.Time                // time the process started
+	started   bool                     // config is loaded
+	warm      bool                     // warm-up is over
+	draining  bool                     // shutdown is in progress (service is not ready)
+	fetches   int                      // # of link fetches in progress
+	ctx       context.Context          // canceled once drain timeout is over
+	cancel    context.CancelFunc       // cancels fetches left
+	sockets   map[*websocket.Conn]bool // websocket connections (hijacked, so not drained by http.Server)
+}
+
+var service lifecycle
+
+// newLifecycle creates state of the running service
+func newLifecycle() lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return lifecycle{mutex: &sync.Mutex{}, startTime: time.Now(), ctx: ctx, cancel: cancel, sockets: make(map[*websocket.Conn]bool)}
+}
+
+// markStarted reports that config is loaded
+func (l *lifecycle) markStarted() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.started = true
+}
+
+// readiness reports whether the service is started and warmed up
+func (l *lifecycle) readiness() (started bool, warm bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.started, l.warm
+}
+
+// startFetch registers a fetch in progress, returned context is canceled
+// if the fetch is not over once drain timeout is over
+func (l *lifecycle) startFetch() context.Context {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.fetches++
+	return l.ctx
+}
+
+// endFetch unregisters the fetch registered by startFetch
+func (l *lifecycle) endFetch() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.fetches--
+}
+
+// addSocket registers websocket connection, so it is closed on shutdown
+func (l *lifecycle) addSocket(ws *websocket.Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sockets[ws] = true
+}
+
+// removeSocket unregisters the connection registered by addSocket
+func (l *lifecycle) removeSocket(ws *websocket.Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.sockets, ws)
+}
+
+// closeSockets asks websocket clients to go away (they close connections
+// in response), if force is set connections are closed right away
+func (l *lifecycle) closeSockets(force bool) {
+	l.mutex.Lock()
+	sockets := make([]*websocket.Conn, 0, len(l.sockets))
+	for ws := range l.sockets {
+		sockets = append(sockets, ws)
+	}
+	l.mutex.Unlock()
+	for _, ws := range sockets {
+		if force {
+			ws.Close()
+		} else {
+			wsCloseCodec.Send(ws, wsGoingAway)
+		}
+	}
+}
+
+// wsCloseCodec sends close frame with the given status
+var wsCloseCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		status := v.(int)
+		return []byte{byte(status >> 8), byte(status)}, websocket.CloseFrame, nil
+	},
+}
+
+// isDraining reports whether shutdown is in progress
+func (l *lifecycle) isDraining() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.draining
+}
+
+// activeFetches returns # of fetches in progress
+func (l *lifecycle) activeFetches() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.fetches
+}
+
+// run serves HTTP and gRPC (if grpcServer is not nil) APIs till SIGTERM
+// or SIGINT, then drains the service. It returns once drained or
+// any of servers fails
+func (l *lifecycle) run(httpServer *http.Server, grpcServer *grpc.Server, grpcListener net.Listener) error {
+	errs := make(chan error, 2)
+	go func() {
+		if httpServer.TLSConfig != nil {
+			errs <- httpServer.ListenAndServeTLS("", "")
+		} else {
+			errs <- httpServer.ListenAndServe()
+		}
+	}()
+	if grpcServer != nil {
+		go func() {
+			errs <- grpcServer.Serve(grpcListener)
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		Info.Println("got", sig, "signal, draining in", drainDelay, "for up to", drainTimeout)
+	}
+	l.drain(httpServer, grpcServer, drainDelay, drainTimeout)
+	return nil
+}
+
+// drain reports the service is not ready and keeps serving for delay, so
+// load balancers stop sending requests, then it stops accepting connections,
+// asks websocket clients to go away and waits up to timeout for requests
+// and fetches in progress (incl. async jobs and websocket drafts),
+// then cancels the rest and flushes logs
+func (l *lifecycle) drain(httpServer *http.Server, grpcServer *grpc.Server, delay, timeout time.Duration) {
+	l.mutex.Lock()
+	l.draining = true
+	l.mutex.Unlock()
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	l.closeSockets(false)
+
+	var wg sync.WaitGroup
+	if grpcServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				grpcServer.Stop()
+			}
+		}()
+	}
+	if err := httpServer.Shutdown(ctx); err != nil {
+		Warning.Println("requests left after drain timeout:", err)
+	}
+	wg.Wait()
+
+	for l.activeFetches() > 0 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := l.activeFetches(); n > 0 {
+		Warning.Println("canceling", n, "fetches left after drain timeout")
+	}
+	l.mutex.Lock()
+	l.cancel()
+	l.mutex.Unlock()
+	l.closeSockets(true)
+	httpServer.Close()
+
+	Info.Println("drained")
+	logFlush()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// streaming formats of the parse endpoint
+const (
+	streamNDJSON = "application/x-ndjson" // one JSON event per line
+	streamSSE    = "text/event-stream"    // Server-Sent Events
+)
+
+// stream event types
+const (
+	eventEntities = "entities" // mentions, emoticons and link placeholders
+	eventLink     = "link"     // result of a single link
+	eventDone     = "done"     // all links are processed
+)
+
+// EntitiesEvent is the first event of the stream, it is sent right away
+// with all links in linkPending status
+type EntitiesEvent struct {
+	Type string `json:"type"`
+	Seq  int64  `json:"seq,omitempty"` // draft seq (websocket only)
+	ServiceResponse
+}
+
+// LinkEvent is sent for every link as soon as it is processed
+type LinkEvent struct {
+	Type string      `json:"type"`
+	Seq  int64       `json:"seq,omitempty"` // draft seq (websocket only)
+	Link URLResponse `json:"link"`
+}
+
+// DoneEvent is the last event of the stream
+type DoneEvent struct {
+	Type string `json:"type"`
+	Seq  int64  `json:"seq,omitempty"` // draft seq (websocket only)
+}
+
+// streamFormat returns streaming format requested by Accept header
+// (empty if the client does not ask for streaming). Streaming formats
+// have to be named explicitly and weighted higher than plain JSON
+// (matched by wildcards as well), on a tie JSON wins, then NDJSON
+func streamFormat(r *http.Request) string {
+	weights := make(map[string]float64)
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if mediaType == "application/ndjson" {
+			mediaType = streamNDJSON
+		}
+		if _, ok := weights[mediaType]; !ok {
+			weights[mediaType] = q
+		}
+	}
+
+	jsonQ, ok := weights["application/json"]
+	if !ok {
+		if jsonQ, ok = weights["application/*"]; !ok {
+			jsonQ = weights["*/*"]
+		}
+	}
+	best, bestQ := "", jsonQ
+	for _, format := range []string{streamNDJSON, streamSSE} {
+		if q := weights[format]; q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// eventWriter writes stream events in the requested format
+// and flushes them to the client right away
+type eventWriter struct {
+	w       http.ResponseWriter
+	format  string
+	flusher http.Flusher
+}
+
+func newEventWriter(w http.ResponseWriter, format string) *eventWriter {
+	w.Header().Set("Content-Type", format+"; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // ask proxies not to buffer the stream
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	return &eventWriter{w, format, flusher}
+}
+
+// write sends a single event, typ is used as SSE event name
+func (e *eventWriter) write(typ string, event interface{}) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if e.format == streamSSE {
+		_, err = fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", typ, b)
+	} else {
+		_, err = fmt.Fprintf(e.w, "%s\n", b)
+	}
+	if err == nil && e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return err
+}
+
+// streamParsing sends mentions, emoticons and link placeholders first
+// and then every link result as soon as processLinks yields it
+func streamParsing(w http.ResponseWriter, r *http.Request, msg string, options *ParseOptions, format string) {
+	events := newEventWriter(w, format)
+	err := parseIncrementally(r.Context(), msg, options,
+		func(entities ServiceResponse) error {
+			return events.write(eventEntities, EntitiesEvent{Type: eventEntities, ServiceResponse: entities})
+		},
+		func(link URLResponse) error {
+			return events.write(eventLink, LinkEvent{Type: eventLink, Link: link})
+		})
+	if err == nil {
+		err = events.write(eventDone, DoneEvent{Type: eventDone})
+	}
+	if err != nil && err != r.Context().Err() {
+		Error.Println(requestID(r), err)
+	}
+}
+
+// parseIncrementally parses the message and reports entities (with all
+// links pending) first and then every link result as soon as it is
+// processed. Outstanding fetches are canceled once ctx is done, it stops
+// on the first error of a callback as well
+func parseIncrementally(ctx context.Context, msg string, options *ParseOptions, entities func(ServiceResponse) error, link func(URLResponse) error) error {
+	unique := options.linksToFetch(parseLinks(msg))
+	pending := make(map[string]URLResponse, len(unique))
+	for _, l := range unique {
+		pending[l] = URLResponse{URL: l, Status: linkPending}
+	}
+	if err := entities(options.apply(newServiceResponse(msg, pending))); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stop fetching once we are done
+	out := processLinksWithOptions(ctx, unique, options.fetchOptions())
+	for {
+		select {
+		case result, ok := <-out:
+			if !ok {
+				return nil
+			}
+			if err := link(options.applyLink(newURLResponse(result))); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err() // client is gone
+		}
+	}
+}
@@ -1,42 +1,96 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"expvar"
+	"net/http"
 	"sync"
+	"time"
 )
 
 // Global is used to store gloabl-level data and enforce application limits
 type Global struct {
-	globalCounter   int64             // stores total number of all processed urls
-	mutex           *sync.Mutex       // control access to shared resource (fetchInProgress)
-	fetchInProgress map[string]string // list of all 'in progress' HTTP requests
-	processesLimit  chan string       // used to limit number of concurrent http request]s
-	expRequests     *expvar.String    // instrumentation: http requests in progress
-	expCounter      *expvar.Int       // instrumentation: # of processed requests (total)
+	globalCounter   int64                 // stores total number of all processed urls
+	mutex           *sync.Mutex           // control access to shared resource (fetchInProgress)
+	fetchInProgress map[string][]string   // list of all 'in progress' HTTP requests (url => API request ids)
+	processesLimit  chan string           // used to limit number of concurrent http request]s
+	expRequests     *expvar.String        // instrumentation: http requests in progress
+	expCounter      *expvar.Int           // instrumentation: # of processed requests (total)
+	hosts           map[string]*hostState // per-host limits state (see addHost)
+	expHostQueues   *expvar.Map           // instrumentation: # of queued/in progress requests per host
+	waiters         map[int64]time.Time   // time requests waiting for processesLimit started to wait
+	waitersSeq      int64                 // id of the last waiting request
+}
+
+// hostState is used to enforce per-host limits
+type hostState struct {
+	slots       chan struct{} // used to limit number of concurrent requests to the host
+	queued      int64         // # of requests to the host either waiting or in progress
+	lastRequest time.Time     // time the last request to the host was (or will be) started
 }
 
 var global Global
 
+// # of host states kept before idle ones are dropped
+const maxHostStates = 10000
+
 // addURL adds an URL to 'fetch in progress list' and increase
-// a counter of total http requests
+// a counter of total http requests, requestID is id of the API request
+// the URL is fetched for (empty if none)
 // - processLimit is used to limit max number of concurrent
 // http requests not to exceed global level (maxHTTPconnections)
 // - mutex is used to make modificiation to underliying
 // map object as thread safe
-func (r *Global) addURL(url string) {
+// It returns ctx error if ctx is done before the slot is available
+func (r *Global) addURL(ctx context.Context, url, requestID string) error {
 	// ensure we do not exceed limit of http connections
 	// by addimg an item to processLimit channel
 	// (in case the cahhnel is full, this call will be blocked and
 	// put on-hold until any previous request is over and the channel
 	// has available slot again)
-	r.processesLimit <- url
+	r.mutex.Lock()
+	r.waitersSeq++
+	id := r.waitersSeq
+	r.waiters[id] = time.Now()
+	r.mutex.Unlock()
+
+	select {
+	case r.processesLimit <- url:
+	case <-ctx.Done():
+		r.mutex.Lock()
+		delete(r.waiters, id)
+		r.mutex.Unlock()
+		return ctx.Err()
+	}
 	// protect all modification by mutex so they are thread-safe
 	r.mutex.Lock()
-	r.fetchInProgress[url] = "in progress"
+	delete(r.waiters, id)
+	if requestID == "" {
+		requestID = "in progress"
+	}
+	r.fetchInProgress[url] = append(r.fetchInProgress[url], requestID)
 	r.globalCounter++
 	r.updateExportedVars()
 	r.mutex.Unlock()
+	return nil
+}
+
+// queueWait returns how long the oldest request waiting
+// for processesLimit has been waiting (0 if nobody waits)
+func (r *Global) queueWait() time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var oldest time.Time
+	for _, t := range r.waiters {
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
 }
 
 // getHTTPRequestsTotal returns number of total attempted http
@@ -47,11 +101,26 @@ func (r *Global) getHTTPRequestsTotal() int {
 	return int(r.globalCounter)
 }
 
-// removeURL removes an URL from 'fetch in progress' list
-func (r *Global) removeURL(url string) {
+// removeURL removes an URL fetched for the API request from 'fetch
+// in progress' list (the same URL may be fetched for other requests)
+func (r *Global) removeURL(url, requestID string) {
+	if requestID == "" {
+		requestID = "in progress"
+	}
 	// protect all modification by mutex so they are thread-safe
 	r.mutex.Lock()
-	delete(r.fetchInProgress, url)
+	ids := r.fetchInProgress[url]
+	for i, id := range ids {
+		if id == requestID {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(r.fetchInProgress, url)
+	} else {
+		r.fetchInProgress[url] = ids
+	}
 	r.updateExportedVars()
 	r.mutex.Unlock()
 
@@ -60,6 +129,106 @@ func (r *Global) removeURL(url string) {
 	<-r.processesLimit
 }
 
+// addHost waits until a request to the given host is allowed and
+// reserves a slot for it. It should be called before addURL, so requests
+// waiting for a busy host do not occupy global slots.
+// - maxHTTPconnectionsPerHost limits number of concurrent requests to the host
+// - minHostDelay enforces minimum delay between two consecutive requests
+// to the same host (each request reserves its own start time, so concurrent
+// requests are spread in time as well)
+// It returns ctx error if ctx is done before the request is allowed,
+// removeHost should not be called then
+func (r *Global) addHost(ctx context.Context, host string) error {
+	r.mutex.Lock()
+	h, ok := r.hosts[host]
+	if !ok {
+		if len(r.hosts) >= maxHostStates {
+			r.dropIdleHosts(time.Now())
+		}
+		h = &hostState{}
+		if maxHTTPconnectionsPerHost > 0 {
+			h.slots = make(chan struct{}, maxHTTPconnectionsPerHost)
+		}
+		r.hosts[host] = h
+	}
+	h.queued++
+	r.expHostQueues.Add(host, 1)
+	r.mutex.Unlock()
+
+	// nil channel means there is no per-host limit
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			r.leaveHost(host, h, false)
+			return ctx.Err()
+		}
+	}
+
+	if minHostDelay > 0 {
+		r.mutex.Lock()
+		now := time.Now()
+		start := h.lastRequest.Add(minHostDelay)
+		if start.Before(now) {
+			start = now
+		}
+		h.lastRequest = start
+		r.mutex.Unlock()
+
+		// the reserved start time is not given back, so requests
+		// queued after this one keep their order
+		timer := time.NewTimer(start.Sub(now))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			r.leaveHost(host, h, true)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// removeHost frees the slot reserved by addHost. State of idle hosts
+// is dropped once politeness delay is over for them (here or by
+// dropIdleHosts later)
+func (r *Global) removeHost(host string) {
+	r.mutex.Lock()
+	h, ok := r.hosts[host]
+	r.mutex.Unlock()
+	if ok {
+		r.leaveHost(host, h, true)
+	}
+}
+
+// leaveHost undoes addHost for a request either done
+// or given up waiting, slot tells whether it holds a slot
+func (r *Global) leaveHost(host string, h *hostState, slot bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if slot && h.slots != nil {
+		<-h.slots
+	}
+	h.queued--
+	r.expHostQueues.Add(host, -1)
+	if h.queued == 0 {
+		r.expHostQueues.Delete(host)
+		if time.Since(h.lastRequest) >= minHostDelay && r.hosts[host] == h {
+			delete(r.hosts, host)
+		}
+	}
+}
+
+// dropIdleHosts removes state of hosts having no requests
+// and politeness delay over (mutex should be held)
+func (r *Global) dropIdleHosts(now time.Time) {
+	for host, h := range r.hosts {
+		if h.queued == 0 && now.Sub(h.lastRequest) >= minHostDelay {
+			delete(r.hosts, host)
+		}
+	}
+}
+
 // updateExportedVars updates all exported vars using internal
 // variables/counters as a source (not theread-safe, thus should be
 // called from thread-safe environment)
@@ -68,3 +237,9 @@ func (r *Global) updateExportedVars() {
 	j, _ := json.Marshal(r.fetchInProgress)
 	r.expRequests.Set(string(j))
 }
+
+// doDebugVarsHandler serves exported vars (requires admin scope
+// when authentication is enabled)
+func doDebugVarsHandler(w http.ResponseWriter, r *http.Request) {
+	expvar.Handler().ServeHTTP(w, r)
+}
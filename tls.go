@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// min interval certificate files are checked for changes with
+const certCheckInterval = time.Second
+
+// client certificate verification modes (-tls-client-auth)
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// certReloader serves certificate loaded from files and reloads it
+// once any of the files is modified. Failed reload keeps the previous
+// certificate, so a half-written pair of files does not break serving
+type certReloader struct {
+	certFile, keyFile string
+	mutex             *sync.Mutex
+	cert              *tls.Certificate
+	modTime           time.Time // latest modification time of the files loaded
+	checked           time.Time // time the files were checked last time
+}
+
+// newCertReloader loads the certificate, it fails if files are not valid
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, mutex: &sync.Mutex{}}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modified returns the latest modification time of the files
+func (r *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload loads the certificate if files were modified since the last load
+// (mutex should be held or reloader should not be shared yet)
+func (r *certReloader) reload() error {
+	r.checked = time.Now()
+	modTime, err := r.modified()
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil {
+		Info.Println("TLS certificate is reloaded from", r.certFile)
+	}
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. Request id is not
+// known during handshake yet, so the client address is logged instead
+func (r *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.checked) >= certCheckInterval {
+		if err := r.reload(); err != nil {
+			client := "-"
+			if hello != nil && hello.Conn != nil {
+				client = hello.Conn.RemoteAddr().String()
+			}
+			Error.Println(client, "TLS certificate is not reloaded:", err)
+		}
+	}
+	return r.cert, nil
+}
+
+// newServerTLSConfig creates TLS config of the API listeners (nil if TLS
+// is not configured). Clients are verified against CAs of clientCAFile
+// (if set) according to clientAuth mode
+func newServerTLSConfig(certFile, keyFile, clientCAFile, clientAuth string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both TLS certificate and key files should be specified")
+	}
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	if clientCAFile == "" {
+		return config, nil
+	}
+	mode, ok := clientAuthModes[clientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown client auth mode %q", clientAuth)
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s has no PEM certificates", clientCAFile)
+	}
+	config.ClientAuth = mode
+	return config, nil
+}
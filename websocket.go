@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// event type of draft processing errors (websocket only)
+const eventError = "error"
+
+// WSDraft is a message draft sent by a websocket client,
+// every next draft supersedes the previous one
+type WSDraft struct {
+	Seq int64  `json:"seq"`
+	Msg string `json:"message"`
+}
+
+// ErrorEvent reports a draft that cannot be processed
+type ErrorEvent struct {
+	Type  string   `json:"type"`
+	Seq   int64    `json:"seq,omitempty"`
+	Error APIError `json:"error"`
+}
+
+// max number of link results cached per websocket connection
+const maxWSCachedLinks = 1000
+
+// wsSession is the state of a single websocket connection
+type wsSession struct {
+	ws        *websocket.Conn
+	requestID string
+	mutex     *sync.Mutex            // serializes writes and protects the fields below
+	cache     map[string]URLResponse // links already fetched on this connection
+	cancel    context.CancelFunc     // cancels processing of the current draft
+	seq       int64                  // seq of the current draft
+}
+
+// websocket subprotocols: browsers pass the API key as wsKeyProtocol
+// (see apiKeySecret) along with wsProtocol, the one selected by server
+const (
+	wsProtocol    = "parser"
+	wsKeyProtocol = "api-key."
+)
+
+// errWSOrigin rejects handshakes of pages from foreign origins
+var errWSOrigin = errors.New("websocket origin is not allowed")
+
+// wsServer accepts connections without Origin header as well (non-browser
+// clients usually do not send it), browsers may connect from pages of the
+// same host or of origins allowed by CORS policy only
+var wsServer = websocket.Server{
+	Handshake: func(config *websocket.Config, r *http.Request) error {
+		// wsProtocol is selected if offered, the key is never echoed back
+		offered := config.Protocol
+		config.Protocol = nil
+		for _, p := range offered {
+			if p == wsProtocol {
+				config.Protocol = []string{wsProtocol}
+			}
+		}
+
+		config.Origin, _ = websocket.Origin(config, r)
+		if r.Header.Get("Origin") == "" {
+			return nil
+		}
+		if config.Origin == nil || (!strings.EqualFold(config.Origin.Host, r.Host) && !cors.allowOrigin(r.Header.Get("Origin"))) {
+			return errWSOrigin
+		}
+		return nil
+	},
+	Handler: serveWebSocket,
+}
+
+// doWebSocketHandler upgrades connection to websocket, the client sends
+// WSDraft messages as the user types and receives incremental results
+// of the latest draft as stream events tagged by the draft seq
+func doWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	wsServer.ServeHTTP(w, r)
+}
+
+// serveWebSocket reads drafts until the connection is closed
+func serveWebSocket(ws *websocket.Conn) {
+	// drafts are limited as REST bodies are (default is 32 MB)
+	ws.MaxPayloadBytes = maxRequestSize
+	s := &wsSession{
+		ws:        ws,
+		requestID: requestID(ws.Request()),
+		mutex:     &sync.Mutex{},
+		cache:     make(map[string]URLResponse),
+		cancel:    func() {},
+	}
+	service.addSocket(ws)
+	defer func() {
+		service.removeSocket(ws)
+		s.mutex.Lock()
+		s.cancel()
+		s.mutex.Unlock()
+	}()
+
+	for {
+		var draft WSDraft
+		if err := websocket.JSON.Receive(ws, &draft); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			e := APIError{Message: err.Error(), RequestID: s.requestID}
+			switch {
+			case errors.As(err, &syntaxErr):
+				e.Code = "malformed_json"
+			case errors.As(err, &typeErr):
+				e.Code = "invalid_field"
+				e.Details = map[string]string{"field": typeErr.Field, "expected": typeErr.Type.String(), "got": typeErr.Value}
+			case errors.Is(err, websocket.ErrFrameTooLarge):
+				// the rest of the frame is skipped by the next Receive
+				e.Code, e.Message = "payload_too_large", "draft is too large"
+				e.Details = map[string]int{"max_size": maxRequestSize}
+			default:
+				return // connection is closed
+			}
+			s.mutex.Lock()
+			s.write(ErrorEvent{eventError, 0, e})
+			s.mutex.Unlock()
+			continue
+		}
+
+		// superseded draft stops fetching its links right away
+		s.mutex.Lock()
+		s.cancel()
+		ctx, cancel := context.WithCancel(ws.Request().Context())
+		s.cancel, s.seq = cancel, draft.Seq
+		s.mutex.Unlock()
+
+		go s.process(ctx, draft)
+	}
+}
+
+// process sends entities and link results of the draft, links fetched
+// for previous drafts are reported right away from the cache
+func (s *wsSession) process(ctx context.Context, draft WSDraft) {
+	links := parseLinks(draft.Msg)
+	known := make(map[string]URLResponse, len(links))
+	fetch := []string{}
+	s.mutex.Lock()
+	for _, link := range links {
+		if _, ok := known[link]; ok {
+			continue
+		}
+		if r, ok := s.cache[link]; ok {
+			known[link] = r
+		} else {
+			known[link] = URLResponse{URL: link, Status: linkPending}
+			fetch = append(fetch, link)
+		}
+	}
+	s.mutex.Unlock()
+
+	// drafts fetching links count against the client's request rate and
+	// hold an in-flight slot till they are done, idle sessions hold none
+	if len(fetch) > 0 {
+		if wait, ok := limiter.allow(clientIP(s.ws.Request())); !ok {
+			details := map[string]float64{"retry_after": wait.Seconds()}
+			s.send(draft.Seq, ErrorEvent{eventError, draft.Seq, APIError{Code: "rate_limited", Message: "too many drafts, slow down", Details: details, RequestID: s.requestID}})
+			return
+		}
+		if err := limiter.acquire(); err != nil {
+			s.send(draft.Seq, ErrorEvent{eventError, draft.Seq, APIError{Code: err.code, Message: err.message, Details: err.details, RequestID: s.requestID}})
+			return
+		}
+		defer limiter.release()
+	}
+	if err := chargeFetches(ctx, len(fetch)); err != nil {
+		s.send(draft.Seq, ErrorEvent{eventError, draft.Seq, APIError{Code: err.code, Message: err.message, Details: err.details, RequestID: s.requestID}})
+		return
+	}
+
+	entities := EntitiesEvent{Type: eventEntities, Seq: draft.Seq, ServiceResponse: newServiceResponse(draft.Msg, known)}
+	if !s.send(draft.Seq, entities) {
+		return
+	}
+	for result := range processLinksContext(ctx, fetch) {
+		response := newURLResponse(result)
+		s.mutex.Lock()
+		if result.status != linkCanceled {
+			if len(s.cache) >= maxWSCachedLinks {
+				s.cache = make(map[string]URLResponse)
+			}
+			s.cache[result.url] = response
+		}
+		s.mutex.Unlock()
+		if !s.send(draft.Seq, LinkEvent{Type: eventLink, Seq: draft.Seq, Link: response}) {
+			return
+		}
+	}
+	s.send(draft.Seq, DoneEvent{Type: eventDone, Seq: draft.Seq})
+}
+
+// send writes the event unless the draft is superseded already,
+// returns false if the draft processing should stop
+func (s *wsSession) send(seq int64, event interface{}) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if seq != s.seq {
+		return false
+	}
+	return s.write(event)
+}
+
+// write sends the event to the client (mutex should be held)
+func (s *wsSession) write(event interface{}) bool {
+	if err := websocket.JSON.Send(s.ws, event); err != nil {
+		Error.Println(s.requestID, err)
+		return false
+	}
+	return true
+}